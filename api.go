@@ -1,9 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
 	"github.com/gin-gonic/gin"
-	"log"
 	"net/http"
 	"time"
 )
@@ -15,13 +14,18 @@ type ApiServer struct {
 	insecureServer   *Server
 }
 
+// CheckAlive runs health checks of all backends until the server stops and
+// publishes their results to etcd
 func (self *ApiServer) CheckAlive() {
-	ticker := time.NewTicker(1 * time.Minute)
+	checker := NewHealthChecker(config.HealthCheck)
+	publisher := NewStatusPublisher(etcdClient, config.EtcdKey, nodeName(), checker.Interval)
+	ticker := time.NewTicker(checker.Interval)
 	quit := make(chan struct{})
 	for {
 		select {
 		case <-ticker.C:
-			log.Printf("Run periodic check alive")
+			checker.CheckAll(collection.BackendList())
+			publisher.Publish(collection.ApplicationBackends())
 		case <-quit:
 			ticker.Stop()
 			return
@@ -29,6 +33,33 @@ func (self *ApiServer) CheckAlive() {
 	}
 }
 
+// setDraining stops or resumes new connections to a backend and reports how
+// many connections are still open on it
+func (self *ApiServer) setDraining(c *gin.Context, draining bool) {
+	id := c.Params.ByName("id")
+	bid := c.Params.ByName("bid")
+	if app, ok := collection.Application(id); ok {
+		if backend, fok := collection.AppBackend(app, bid); fok {
+			backend.Drain(draining)
+			c.JSON(200, gin.H{
+				"status":      true,
+				"draining":    backend.Draining(),
+				"connections": backend.Connections(),
+			})
+		} else {
+			c.JSON(200, gin.H{
+				"status": false,
+				"error":  "Backend not found",
+			})
+		}
+	} else {
+		c.JSON(200, gin.H{
+			"status": false,
+			"error":  "Application not found",
+		})
+	}
+}
+
 func (self *ApiServer) ListenAndServe(listen string) {
 	gin.SetMode(gin.ReleaseMode)
 
@@ -48,12 +79,28 @@ func (self *ApiServer) ListenAndServe(listen string) {
 	{
 		// Applications
 		v1.GET("/", func(c *gin.Context) {
-			c.JSON(200, collection.Applications)
+			data, err := collection.MarshalApplications()
+			if err != nil {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  err.Error(),
+				})
+				return
+			}
+			c.JSON(200, json.RawMessage(data))
 		})
 		v1.GET("/:id", func(c *gin.Context) {
 			id := c.Params.ByName("id")
-			if _, ok := collection.Applications[id]; ok {
-				c.JSON(200, collection.Applications[id])
+			if app, ok := collection.Application(id); ok {
+				data, err := collection.MarshalApplication(app)
+				if err != nil {
+					c.JSON(200, gin.H{
+						"status": false,
+						"error":  err.Error(),
+					})
+					return
+				}
+				c.JSON(200, json.RawMessage(data))
 			} else {
 				c.JSON(200, gin.H{
 					"status": false,
@@ -74,7 +121,7 @@ func (self *ApiServer) ListenAndServe(listen string) {
 					"error":  "missing id",
 				})
 			} else {
-				if _, ok := collection.Applications[appJson.Id]; ok {
+				if _, ok := collection.Application(appJson.Id); ok {
 					c.JSON(200, gin.H{
 						"status": false,
 						"error":  "application already exists",
@@ -94,10 +141,119 @@ func (self *ApiServer) ListenAndServe(listen string) {
 				}
 			}
 		})
+		v1.GET("/:id/status", func(c *gin.Context) {
+			id := c.Params.ByName("id")
+			if _, ok := collection.Application(id); !ok {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  "application not found",
+				})
+				return
+			}
+
+			r, err := etcdClient.Get(statusKey(config.EtcdKey, id), false, true)
+			if err != nil {
+				// nothing published yet
+				c.JSON(200, gin.H{
+					"status":   true,
+					"backends": aggregateStatus(nil),
+				})
+				return
+			}
+			c.JSON(200, gin.H{
+				"status":   true,
+				"backends": aggregateStatus(r.Node),
+			})
+		})
+		v1.GET("/:id/health", func(c *gin.Context) {
+			id := c.Params.ByName("id")
+			if app, ok := collection.Application(id); ok {
+				healthy := 0
+				list := collection.AppBackends(app)
+				backends := make(map[string]BackendHealth, len(list))
+				for _, backend := range list {
+					// the latest check is enough to spot the failing ones
+					backends[backend.Id] = backend.Health(1)
+					if backend.Healthy() {
+						healthy++
+					}
+				}
+				c.JSON(200, gin.H{
+					"status":    true,
+					"healthy":   healthy,
+					"unhealthy": len(backends) - healthy,
+					"backends":  backends,
+				})
+			} else {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  "application not found",
+				})
+			}
+		})
+		v1.GET("/:id/groups", func(c *gin.Context) {
+			id := c.Params.ByName("id")
+			if app, ok := collection.Application(id); ok {
+				c.JSON(200, gin.H{
+					"status": true,
+					"groups": collection.AppGroups(app),
+				})
+			} else {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  "application not found",
+				})
+			}
+		})
+		v1.POST("/:id/groups", func(c *gin.Context) {
+			id := c.Params.ByName("id")
+			if app, ok := collection.Application(id); ok {
+				var weights map[string]int
+				err := json.NewDecoder(c.Request.Body).Decode(&weights)
+				if err == nil {
+					err = app.SaveGroups(weights)
+				}
+				if err != nil {
+					c.JSON(200, gin.H{
+						"status": false,
+						"error":  err.Error(),
+					})
+				} else {
+					c.JSON(200, gin.H{
+						"status": true,
+					})
+				}
+			} else {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  "application not found",
+				})
+			}
+		})
+		v1.DELETE("/:id/groups", func(c *gin.Context) {
+			id := c.Params.ByName("id")
+			if app, ok := collection.Application(id); ok {
+				if err := app.DeleteGroups(); err != nil {
+					c.JSON(200, gin.H{
+						"status": false,
+						"error":  err.Error(),
+					})
+				} else {
+					c.JSON(200, gin.H{
+						"status": true,
+					})
+				}
+			} else {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  "application not found",
+				})
+			}
+		})
 		v1.DELETE("/:id", func(c *gin.Context) {
 			id := c.Params.ByName("id")
-			if _, ok := collection.Applications[id]; ok {
-				err := collection.Applications[id].Delete()
+			if app, ok := collection.Application(id); ok {
+				err := app.Delete()
 				if err != nil {
 					c.JSON(200, gin.H{
 						"status": false,
@@ -120,8 +276,8 @@ func (self *ApiServer) ListenAndServe(listen string) {
 		v1.GET("/:id/frontend/:fid", func(c *gin.Context) {
 			id := c.Params.ByName("id")
 			fid := c.Params.ByName("fid")
-			if app, ok := collection.Applications[id]; ok {
-				if frontend, fok := app.Frontends[fid]; fok {
+			if app, ok := collection.Application(id); ok {
+				if frontend, fok := collection.AppFrontend(app, fid); fok {
 					c.JSON(200, frontend)
 				} else {
 					c.JSON(200, gin.H{
@@ -139,33 +295,39 @@ func (self *ApiServer) ListenAndServe(listen string) {
 		v1.POST("/:id/frontend/:fid", func(c *gin.Context) {
 			id := c.Params.ByName("id")
 			fid := c.Params.ByName("fid")
-			if app, ok := collection.Applications[id]; ok {
-				err := app.DeleteFrontend(fid)
+			if app, ok := collection.Application(id); ok {
+				var tmp FrontendTmp
+				c.Bind(&tmp)
+
+				frontend, err := newFrontendFromTmp(fid, tmp)
 				if err != nil {
 					c.JSON(200, gin.H{
 						"status": false,
-						"error":  err,
+						"error":  err.Error(),
 					})
+					return
 				}
 
-				frontend := NewFrontend(fid)
-
-				var tmp FrontendTmp
-				c.Bind(tmp)
-
-				frontend.Hosts = tmp.Hosts
-
-				if tmp.TLSCrt != "" || tmp.TLSKey != "" {
-					err := frontend.SetTLS(tmp.TLSCrt, tmp.TLSCrt)
-					if err != nil {
-						c.JSON(200, gin.H{
-							"status": false,
-							"err":    err,
-						})
+				if existing, fok := collection.AppFrontend(app, fid); fok {
+					if existing.sameListeners(frontend) {
+						// listeners are the same, update the settings live
+						if err := existing.Update(frontend); err != nil {
+							c.JSON(200, gin.H{
+								"status": false,
+								"error":  err.Error(),
+							})
+						} else {
+							c.JSON(200, gin.H{
+								"status": true,
+							})
+						}
 						return
 					}
+					collection.DeleteAppFrontend(app, fid)
 				}
 
+				collection.AddAppFrontend(app, frontend)
+
 				if frontend.isSecure() {
 					self.secureServer.AddFrontend(frontend)
 					go self.secureServer.RunFrontend(frontend)
@@ -187,8 +349,8 @@ func (self *ApiServer) ListenAndServe(listen string) {
 		v1.DELETE("/:id/frontend/:fid", func(c *gin.Context) {
 			id := c.Params.ByName("id")
 			fid := c.Params.ByName("fid")
-			if app, ok := collection.Applications[id]; ok {
-				err := app.DeleteFrontend(fid)
+			if app, ok := collection.Application(id); ok {
+				err := collection.DeleteAppFrontend(app, fid)
 				if err != nil {
 					c.JSON(200, gin.H{
 						"status": false,
@@ -211,8 +373,8 @@ func (self *ApiServer) ListenAndServe(listen string) {
 		v1.GET("/:id/backend/:bid", func(c *gin.Context) {
 			id := c.Params.ByName("id")
 			bid := c.Params.ByName("bid")
-			if app, ok := collection.Applications[id]; ok {
-				if backend, fok := app.Backends[bid]; fok {
+			if app, ok := collection.Application(id); ok {
+				if backend, fok := collection.AppBackend(app, bid); fok {
 					c.JSON(200, backend)
 				} else {
 					c.JSON(200, gin.H{
@@ -230,34 +392,20 @@ func (self *ApiServer) ListenAndServe(listen string) {
 		v1.POST("/:id/backend/:bid", func(c *gin.Context) {
 			id := c.Params.ByName("id")
 			bid := c.Params.ByName("bid")
-			if app, ok := collection.Applications[id]; ok {
-				err := app.DeleteFrontend(bid)
-				if err != nil {
-					c.JSON(200, gin.H{
-						"status": false,
-						"error":  err,
-					})
-				}
-
-				backend := NewBackend(bid)
-
+			if app, ok := collection.Application(id); ok {
 				var tmp BackendTmp
-				c.Bind(tmp)
+				c.Bind(&tmp)
 
-				if tmp.Url == "" {
+				backend, err := newBackendFromTmp(bid, tmp)
+				if err != nil {
 					c.JSON(200, gin.H{
 						"status": false,
-						"error":  fmt.Sprintf("Skip backend with incorrect url %s", id),
+						"error":  err.Error(),
 					})
 					return
 				}
-				backend.Url = tmp.Url
 
-				if tmp.ConnectTimeout != 0 {
-					backend.ConnectTimeout = tmp.ConnectTimeout
-				}
-
-				app.AddBackend(backend)
+				collection.AddAppBackend(app, backend)
 
 				c.JSON(200, gin.H{
 					"status": true,
@@ -272,8 +420,8 @@ func (self *ApiServer) ListenAndServe(listen string) {
 		v1.DELETE("/:id/backend/:bid", func(c *gin.Context) {
 			id := c.Params.ByName("id")
 			bid := c.Params.ByName("bid")
-			if app, ok := collection.Applications[id]; ok {
-				err := app.DeleteBackend(bid)
+			if app, ok := collection.Application(id); ok {
+				err := collection.DeleteAppBackend(app, bid)
 				if err != nil {
 					c.JSON(200, gin.H{
 						"status": false,
@@ -291,6 +439,31 @@ func (self *ApiServer) ListenAndServe(listen string) {
 				})
 			}
 		})
+		v1.GET("/:id/backend/:bid/health", func(c *gin.Context) {
+			id := c.Params.ByName("id")
+			bid := c.Params.ByName("bid")
+			if app, ok := collection.Application(id); ok {
+				if backend, fok := collection.AppBackend(app, bid); fok {
+					c.JSON(200, backend.Health(healthHistorySize))
+				} else {
+					c.JSON(200, gin.H{
+						"status": false,
+						"error":  "Backend not found",
+					})
+				}
+			} else {
+				c.JSON(200, gin.H{
+					"status": false,
+					"error":  "Application not found",
+				})
+			}
+		})
+		v1.POST("/:id/backend/:bid/drain", func(c *gin.Context) {
+			self.setDraining(c, true)
+		})
+		v1.DELETE("/:id/backend/:bid/drain", func(c *gin.Context) {
+			self.setDraining(c, false)
+		})
 	}
 
 	s := &http.Server{
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -18,6 +19,8 @@ type Application struct {
 	Id        string               `json:"id"`
 	Frontends map[string]*Frontend `json:"frontends"`
 	Backends  map[string]Backend   `json:"backends"`
+	// share of the traffic of every backend group
+	Groups map[string]int `json:"groups,omitempty"`
 }
 
 func (self *Application) Create() (err error) {
@@ -30,6 +33,25 @@ func (self *Application) Delete() (err error) {
 	return err
 }
 
+// SaveGroups writes the group weights to etcd, the watcher of every proxy
+// node applies them
+func (self *Application) SaveGroups(weights map[string]int) error {
+	if err := validateGroupWeights(weights); err != nil {
+		return err
+	}
+	data, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+	_, err = etcdClient.Set("/"+config.EtcdKey+"/"+self.Id+"/groups", string(data), 0)
+	return err
+}
+
+func (self *Application) DeleteGroups() (err error) {
+	_, err = etcdClient.Delete("/"+config.EtcdKey+"/"+self.Id+"/groups", false)
+	return err
+}
+
 func (s *Application) Stop() {
 	for _, frontend := range s.Frontends {
 		frontend.Stop()
@@ -42,10 +64,56 @@ func (s *Application) Start() {
 	}
 }
 
+// BackendList returns the backends of the application. For applications of
+// the collection use Collection.AppBackends, which holds its lock.
+func (s *Application) BackendList() []Backend {
+	backends := make([]Backend, 0, len(s.Backends))
+	for _, backend := range s.Backends {
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// AddBackend adds a new backend or replaces the settings of a known one.
+// New backends ramp up their share of connections over the slow start window.
 func (s *Application) AddBackend(backend Backend) {
+	old, ok := s.Backends[backend.Id]
+	if !ok {
+		backend.startSlowStart()
+		s.Backends[backend.Id] = backend
+		for _, frontend := range s.Frontends {
+			frontend.AddBackend(backend)
+		}
+		return
+	}
+
+	// keep live counters and the ramp of the connections proxied so far, the
+	// json only sets its own draining, a drain of the API stays
+	draining := backend.Draining()
+	backend.stats = old.stats
+	backend.SetDraining(draining)
+
+	// swap the backend in one step, the frontends never go without it
+	s.Backends[backend.Id] = backend
+	backends := s.BackendList()
+	for _, frontend := range s.Frontends {
+		frontend.SetBackends(backends)
+	}
+}
+
+// SetGroups changes the traffic split between the backend groups of all
+// frontends, nil sends everything to the backends without a group. For
+// applications of the collection use Collection.SetAppGroups.
+func (s *Application) SetGroups(weights map[string]int) error {
+	if err := validateGroupWeights(weights); err != nil {
+		return err
+	}
+
+	s.Groups = weights
 	for _, frontend := range s.Frontends {
-		frontend.AddBackend(backend)
+		frontend.SetGroupWeights(weights)
 	}
+	return nil
 }
 
 func (s *Application) DeleteBackend(id string) error {
@@ -63,13 +131,3 @@ func (s *Application) DeleteBackend(id string) error {
 
 	return errors.New(fmt.Sprintf("Unknown backend id: %s", id))
 }
-
-func (s *Application) DeleteFrontend(id string) error {
-	if frontend, ok := s.Frontends[id]; ok {
-		frontend.Stop()
-		delete(s.Frontends, id)
-		return nil
-	}
-
-	return errors.New(fmt.Sprintf("Unknown backend id: %s", id))
-}
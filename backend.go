@@ -1,15 +1,294 @@
 package main
 
+import (
+	"encoding/json"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// weight of the newest sample in the dial latency average
+	dialLatencyDecay = 0.3
+	// how long a backend is treated as unhealthy after a failed dial
+	failTimeout = 10 * time.Second
+)
+
 type Backend struct {
 	Id             string `json:"id"`
-	Url            string `"json:url"`
-	ConnectTimeout int    `json:connect_timeout"`
+	Url            string `json:"url"`
+	ConnectTimeout int    `json:"connect_timeout"`
+	Weight         int    `json:"weight"`
+	Priority       int    `json:"priority"`
+	Backup         bool   `json:"backup"`
+	SlowStart      int    `json:"slow_start"` // seconds
+	// how the health checker probes the backend, plain TCP connect if nil
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+	// PROXY protocol version announcing the client to the backend, v1 or v2
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+	// selects the backend for the routes of frontends
+	Tags []string `json:"tags,omitempty"`
+	// canary or other group, the regular backends have none
+	Group string `json:"group,omitempty"`
+
+	// shared by every copy of the backend held by frontends and strategies
+	stats *backendStats
+}
+
+// backendStats holds runtime counters of a backend
+type backendStats struct {
+	connections int64
+	// float64 bits of the dial latency EWMA in nanoseconds
+	dialLatency uint64
+	// unix nanoseconds until which the backend is treated as failed
+	failedUntil int64
+	// unix nanoseconds when the slow start ramp began, 0 if not ramping
+	rampStart int64
+	// 1 while the backend takes no new connections, as set in its json
+	draining int32
+	// 1 while drained through the API, kept across updates of the json
+	drained int32
+	// 1 while active health checks fail
+	down int32
+
+	// dials failed in a row
+	dialFailures int32
+	// unix nanoseconds until which outlier detection keeps the backend out
+	ejectedUntil int64
+	// ejections so far, each one lasts twice as long as the previous
+	ejections int32
+
+	circuit circuit
+
+	// consecutive health check results, only touched by the checker
+	checkSuccesses int
+	checkFailures  int
+	history        healthHistory
 }
 
 func NewBackend(id string) Backend {
 	backend := Backend{
 		Id:             id,
 		ConnectTimeout: defaultConnectTimeout,
+		Weight:         defaultWeight,
+		stats:          &backendStats{},
 	}
 	return backend
 }
+
+// Connections returns the number of live proxied connections to the backend
+func (b Backend) Connections() int64 {
+	if b.stats == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.stats.connections)
+}
+
+func (b Backend) connOpened() {
+	if b.stats != nil {
+		atomic.AddInt64(&b.stats.connections, 1)
+	}
+}
+
+func (b Backend) connClosed() {
+	if b.stats != nil {
+		atomic.AddInt64(&b.stats.connections, -1)
+	}
+}
+
+func (b Backend) MarshalJSON() ([]byte, error) {
+	type backendJson Backend
+	return json.Marshal(struct {
+		backendJson
+		Connections int64  `json:"connections"`
+		Draining    bool   `json:"draining"`
+		Healthy     bool   `json:"healthy"`
+		Ejected     bool   `json:"ejected"`
+		Circuit     string `json:"circuit"`
+	}{backendJson(b), b.Connections(), b.Draining(), b.Healthy(), b.Ejected(), b.CircuitState()})
+}
+
+// Available reports whether the backend may get new connections
+func (b Backend) Available() bool {
+	if b.stats != nil && !b.stats.circuit.allows() {
+		return false
+	}
+	return !b.Draining() && b.Healthy() && !b.Ejected()
+}
+
+// Ejected reports whether outlier detection keeps the backend out of rotation
+func (b Backend) Ejected() bool {
+	return b.stats != nil && time.Now().UnixNano() < atomic.LoadInt64(&b.stats.ejectedUntil)
+}
+
+// Healthy reports whether the backend passes active health checks
+func (b Backend) Healthy() bool {
+	return b.stats == nil || atomic.LoadInt32(&b.stats.down) == 0
+}
+
+func (b Backend) setHealthy(healthy bool) {
+	if b.stats == nil {
+		return
+	}
+	if healthy {
+		atomic.StoreInt32(&b.stats.down, 0)
+	} else {
+		atomic.StoreInt32(&b.stats.down, 1)
+	}
+}
+
+// Draining reports whether the backend only serves the connections it already has
+func (b Backend) Draining() bool {
+	return b.stats != nil && (atomic.LoadInt32(&b.stats.draining) == 1 || atomic.LoadInt32(&b.stats.drained) == 1)
+}
+
+// Drain stops or resumes new connections to the backend on request of an
+// operator. The drain outlives updates of the backend json, resuming clears
+// the draining of the json too.
+func (b Backend) Drain(drain bool) {
+	if b.stats == nil {
+		return
+	}
+	if drain {
+		atomic.StoreInt32(&b.stats.drained, 1)
+	} else {
+		atomic.StoreInt32(&b.stats.drained, 0)
+		atomic.StoreInt32(&b.stats.draining, 0)
+	}
+}
+
+// SetDraining sets the draining of the backend json
+func (b Backend) SetDraining(draining bool) {
+	if b.stats == nil {
+		return
+	}
+	if draining {
+		atomic.StoreInt32(&b.stats.draining, 1)
+	} else {
+		atomic.StoreInt32(&b.stats.draining, 0)
+	}
+}
+
+func (b Backend) hasTag(tag string) bool {
+	for _, t := range b.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// group returns the group of the backend, the default one if not set
+func (b Backend) group() string {
+	if b.Group == "" {
+		return defaultGroup
+	}
+	return b.Group
+}
+
+// weight returns the weight of the backend, at least 1
+func (b Backend) weight() int {
+	if b.Weight < 1 {
+		return 1
+	}
+	return b.Weight
+}
+
+// tierKey orders the priority tiers, every primary tier comes before every
+// backup tier
+type tierKey struct {
+	backup   bool
+	priority int
+}
+
+func (k tierKey) before(other tierKey) bool {
+	if k.backup != other.backup {
+		return other.backup
+	}
+	return k.priority < other.priority
+}
+
+// tier returns the priority tier of the backend, lower tiers are used first
+func (b Backend) tier() tierKey {
+	return tierKey{b.Backup, b.Priority}
+}
+
+// startSlowStart begins ramping the share of new connections of the backend
+func (b Backend) startSlowStart() {
+	if b.stats != nil && b.SlowStart > 0 {
+		atomic.StoreInt64(&b.stats.rampStart, time.Now().UnixNano())
+	}
+}
+
+// rampFactor returns the share of its normal traffic the backend should get,
+// growing linearly from 0 to 1 over the slow start window
+func (b Backend) rampFactor() float64 {
+	if b.stats == nil || b.SlowStart <= 0 {
+		return 1
+	}
+
+	started := atomic.LoadInt64(&b.stats.rampStart)
+	if started == 0 {
+		return 1
+	}
+
+	elapsed := time.Now().UnixNano() - started
+	window := int64(time.Duration(b.SlowStart) * time.Second)
+	if elapsed >= window {
+		atomic.CompareAndSwapInt64(&b.stats.rampStart, started, 0)
+		return 1
+	}
+
+	return float64(elapsed) / float64(window)
+}
+
+// DialLatency returns the moving average of the time it takes to dial the backend
+func (b Backend) DialLatency() time.Duration {
+	if b.stats == nil {
+		return 0
+	}
+	return time.Duration(math.Float64frombits(atomic.LoadUint64(&b.stats.dialLatency)))
+}
+
+// failing reports whether the backend has failed a dial recently
+func (b Backend) failing() bool {
+	if b.stats == nil {
+		return false
+	}
+	return time.Now().UnixNano() < atomic.LoadInt64(&b.stats.failedUntil)
+}
+
+// score is the expected cost of sending one more connection to the backend:
+// the dial latency average scaled by the connections already outstanding
+func (b Backend) score() float64 {
+	return float64(b.DialLatency()+1) * float64(b.Connections()+1)
+}
+
+func (b Backend) dialSucceeded(latency time.Duration) {
+	if b.stats == nil {
+		return
+	}
+	atomic.StoreInt64(&b.stats.failedUntil, 0)
+	atomic.StoreInt32(&b.stats.dialFailures, 0)
+	for {
+		old := atomic.LoadUint64(&b.stats.dialLatency)
+		avg := math.Float64frombits(old)
+		if avg == 0 {
+			avg = float64(latency)
+		} else {
+			avg += dialLatencyDecay * (float64(latency) - avg)
+		}
+		if atomic.CompareAndSwapUint64(&b.stats.dialLatency, old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// dialFailed returns the number of dials failed in a row
+func (b Backend) dialFailed() int {
+	if b.stats == nil {
+		return 0
+	}
+	atomic.StoreInt64(&b.stats.failedUntil, time.Now().Add(failTimeout).UnixNano())
+	return int(atomic.AddInt32(&b.stats.dialFailures, 1))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBreakerFailureRate = 50    // percent
+	defaultBreakerMinRequests = 20    // per window
+	defaultBreakerWindow      = 10000 // milliseconds
+	defaultBreakerOpenTimeout = 30000 // milliseconds
+	defaultBreakerTrials      = 3
+)
+
+const (
+	circuitClosed int32 = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// returned when the only backends left were refused by their breakers
+var errCircuitOpen = errors.New("Circuit breaker open")
+
+var circuitStates = map[int32]string{
+	circuitClosed:   "closed",
+	circuitOpen:     "open",
+	circuitHalfOpen: "half_open",
+}
+
+type BreakerConfig struct {
+	// percent of failed connections in a window that opens the circuit,
+	// -1 disables the breakers
+	FailureRate int `json:"failure_rate"`
+	// connections a window needs before its failure rate counts
+	MinRequests int `json:"min_requests"`
+	Window      int `json:"window"`       // milliseconds
+	OpenTimeout int `json:"open_timeout"` // milliseconds
+	// trial connections let through while half-open, as many successes close it
+	HalfOpenTrials int `json:"half_open_trials"`
+}
+
+// CircuitBreaker holds the settings of the per-backend breakers. A breaker
+// opens when too many connections to its backend fail and refuses new ones
+// for OpenTimeout. It then goes half-open and lets HalfOpenTrials
+// connections through: the circuit closes when all of them succeed and opens
+// again on the first failure, so a recovering backend is not hit by a retry
+// storm.
+type CircuitBreaker struct {
+	FailureRate    int
+	MinRequests    int
+	Window         time.Duration
+	OpenTimeout    time.Duration
+	HalfOpenTrials int
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		FailureRate:    defaultBreakerFailureRate,
+		MinRequests:    defaultBreakerMinRequests,
+		Window:         defaultBreakerWindow * time.Millisecond,
+		OpenTimeout:    defaultBreakerOpenTimeout * time.Millisecond,
+		HalfOpenTrials: defaultBreakerTrials,
+	}
+
+	if cfg.FailureRate != 0 {
+		cb.FailureRate = cfg.FailureRate
+	}
+	if cfg.MinRequests > 0 {
+		cb.MinRequests = cfg.MinRequests
+	}
+	if cfg.Window > 0 {
+		cb.Window = time.Duration(cfg.Window) * time.Millisecond
+	}
+	if cfg.OpenTimeout > 0 {
+		cb.OpenTimeout = time.Duration(cfg.OpenTimeout) * time.Millisecond
+	}
+	if cfg.HalfOpenTrials > 0 {
+		cb.HalfOpenTrials = cfg.HalfOpenTrials
+	}
+
+	return cb
+}
+
+func (cb *CircuitBreaker) enabled() bool {
+	return cb != nil && cb.FailureRate > 0
+}
+
+// circuit is the breaker state of one backend
+type circuit struct {
+	// read without locking by Backend.Available
+	state int32
+	// unix nanoseconds when an open circuit lets trials through
+	retryAt int64
+
+	mu        sync.Mutex
+	windowEnd time.Time
+	requests  int
+	failures  int
+	// trial connections in flight and succeeded while half-open
+	trials    int
+	successes int
+	// counts the half-open periods, trials belong to one of them
+	period int
+}
+
+// allows reports whether the circuit may let a connection through
+func (c *circuit) allows() bool {
+	return atomic.LoadInt32(&c.state) != circuitOpen || time.Now().UnixNano() >= atomic.LoadInt64(&c.retryAt)
+}
+
+// Acquire lets a connection to backend through. Every acquired connection
+// must be followed by Record with the returned trial, which names the
+// half-open period the connection is a trial of, 0 for regular connections.
+func (cb *CircuitBreaker) Acquire(backend Backend) (bool, int) {
+	if !cb.enabled() || backend.stats == nil {
+		return true, 0
+	}
+
+	c := &backend.stats.circuit
+	if atomic.LoadInt32(&c.state) == circuitClosed {
+		return true, 0
+	}
+	if !c.allows() {
+		return false, 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch atomic.LoadInt32(&c.state) {
+	case circuitClosed:
+		return true, 0
+	case circuitOpen:
+		log.Printf("Circuit of backend %s is half-open", backend.Id)
+		atomic.StoreInt32(&c.state, circuitHalfOpen)
+		c.trials, c.successes = 0, 0
+		c.period++
+	}
+
+	if c.trials+c.successes >= cb.HalfOpenTrials {
+		return false, 0
+	}
+	c.trials++
+	return true, c.period
+}
+
+// Record counts the outcome of a connection let through by Acquire. While
+// half-open only the trials of the current period count, connections that
+// started earlier say nothing about the recovery of the backend.
+func (cb *CircuitBreaker) Record(backend Backend, trial int, ok bool) {
+	if !cb.enabled() || backend.stats == nil {
+		return
+	}
+
+	c := &backend.stats.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	switch atomic.LoadInt32(&c.state) {
+	case circuitHalfOpen:
+		if trial != c.period {
+			return
+		}
+		c.trials--
+		if !ok {
+			cb.open(backend, c, now)
+			return
+		}
+		if c.successes++; c.successes >= cb.HalfOpenTrials {
+			log.Printf("Circuit of backend %s is closed", backend.Id)
+			atomic.StoreInt32(&c.state, circuitClosed)
+			c.windowEnd = time.Time{}
+		}
+	case circuitClosed:
+		if now.After(c.windowEnd) {
+			c.windowEnd = now.Add(cb.Window)
+			c.requests, c.failures = 0, 0
+		}
+		c.requests++
+		if !ok {
+			c.failures++
+		}
+		if c.requests >= cb.MinRequests && c.failures*100 >= cb.FailureRate*c.requests {
+			cb.open(backend, c, now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) open(backend Backend, c *circuit, now time.Time) {
+	log.Printf("Circuit of backend %s is open", backend.Id)
+	atomic.StoreInt64(&c.retryAt, now.Add(cb.OpenTimeout).UnixNano())
+	atomic.StoreInt32(&c.state, circuitOpen)
+}
+
+// CircuitState returns the state of the circuit breaker of the backend
+func (b Backend) CircuitState() string {
+	if b.stats == nil {
+		return circuitStates[circuitClosed]
+	}
+	return circuitStates[atomic.LoadInt32(&b.stats.circuit.state)]
+}
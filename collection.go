@@ -1,9 +1,21 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
 type Collection struct {
 	Applications map[string]*Application
 	Backends     map[string]Backend
 	Frontends    map[string]*Frontend
+
+	// guards Backends, Frontends, Applications and the backends, frontends
+	// and groups of every application, which the health checker and the
+	// status publisher read in the background
+	backendsLock sync.RWMutex
 }
 
 func NewCollection() *Collection {
@@ -15,5 +27,150 @@ func NewCollection() *Collection {
 }
 
 func (c *Collection) AddApplication(app *Application) {
+	c.backendsLock.Lock()
+	defer c.backendsLock.Unlock()
 	c.Applications[app.Id] = app
 }
+
+// DeleteApplication removes an application and stops its frontends
+func (c *Collection) DeleteApplication(id string) {
+	c.backendsLock.Lock()
+	var frontends []*Frontend
+	if app, ok := c.Applications[id]; ok {
+		for _, frontend := range app.Frontends {
+			frontends = append(frontends, frontend)
+		}
+		delete(c.Applications, id)
+	}
+	c.backendsLock.Unlock()
+
+	for _, frontend := range frontends {
+		frontend.Stop()
+	}
+}
+
+func (c *Collection) Application(id string) (*Application, bool) {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	app, ok := c.Applications[id]
+	return app, ok
+}
+
+// MarshalApplications encodes every application, with its backends and
+// frontends, to json
+func (c *Collection) MarshalApplications() ([]byte, error) {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	return json.Marshal(c.Applications)
+}
+
+func (c *Collection) MarshalApplication(app *Application) ([]byte, error) {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	return json.Marshal(app)
+}
+
+// AddAppFrontend adds a frontend to app, balancing the backends of app
+func (c *Collection) AddAppFrontend(app *Application, frontend *Frontend) {
+	c.backendsLock.Lock()
+	defer c.backendsLock.Unlock()
+	frontend.SetBackends(app.BackendList())
+	frontend.SetGroupWeights(app.Groups)
+	app.Frontends[frontend.Id] = frontend
+	c.Frontends[frontend.Id] = frontend
+}
+
+// DeleteAppFrontend removes a frontend of app and stops it
+func (c *Collection) DeleteAppFrontend(app *Application, id string) error {
+	c.backendsLock.Lock()
+	frontend, ok := app.Frontends[id]
+	if ok {
+		delete(app.Frontends, id)
+		delete(c.Frontends, id)
+	}
+	c.backendsLock.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown frontend id: %s", id))
+	}
+	frontend.Stop()
+	return nil
+}
+
+func (c *Collection) AppFrontend(app *Application, id string) (*Frontend, bool) {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	frontend, ok := app.Frontends[id]
+	return frontend, ok
+}
+
+// SetAppGroups changes the traffic split between the backend groups of app
+func (c *Collection) SetAppGroups(app *Application, weights map[string]int) error {
+	c.backendsLock.Lock()
+	defer c.backendsLock.Unlock()
+	return app.SetGroups(weights)
+}
+
+func (c *Collection) AppGroups(app *Application) map[string]int {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	return app.Groups
+}
+
+func (c *Collection) SetBackend(backend Backend) {
+	c.backendsLock.Lock()
+	defer c.backendsLock.Unlock()
+	c.Backends[backend.Id] = backend
+}
+
+// AddAppBackend adds a new backend to app or replaces a known one
+func (c *Collection) AddAppBackend(app *Application, backend Backend) {
+	c.backendsLock.Lock()
+	defer c.backendsLock.Unlock()
+	app.AddBackend(backend)
+	c.Backends[backend.Id] = app.Backends[backend.Id]
+}
+
+func (c *Collection) DeleteAppBackend(app *Application, id string) error {
+	c.backendsLock.Lock()
+	defer c.backendsLock.Unlock()
+	delete(c.Backends, id)
+	return app.DeleteBackend(id)
+}
+
+func (c *Collection) BackendList() []Backend {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+
+	backends := make([]Backend, 0, len(c.Backends))
+	for _, backend := range c.Backends {
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// AppBackends returns the backends of app
+func (c *Collection) AppBackends(app *Application) []Backend {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	return app.BackendList()
+}
+
+func (c *Collection) AppBackend(app *Application, id string) (Backend, bool) {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+	backend, ok := app.Backends[id]
+	return backend, ok
+}
+
+// ApplicationBackends returns the backends of every application by id
+func (c *Collection) ApplicationBackends() map[string][]Backend {
+	c.backendsLock.RLock()
+	defer c.backendsLock.RUnlock()
+
+	backends := make(map[string][]Backend, len(c.Applications))
+	for id, app := range c.Applications {
+		backends[id] = app.BackendList()
+	}
+	return backends
+}
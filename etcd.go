@@ -11,17 +11,42 @@ import (
 
 const (
 	defaultConnectTimeout = 10000 // milliseconds
+	defaultWeight         = 1
+	defaultDialAttempts   = 3
 )
 
 type FrontendTmp struct {
-	Hosts  []string `json:"hosts"`
-	TLSCrt string   `json:"tls_crt"`
-	TLSKey string   `json:"tls_key"`
+	Hosts          []string        `json:"hosts"`
+	TLSCrt         string          `json:"tls_crt"`
+	TLSKey         string          `json:"tls_key"`
+	Mode           string          `json:"mode"`
+	Strategy       string          `json:"strategy"`
+	StrategyParams json.RawMessage `json:"strategy_params"`
+	DialAttempts   int             `json:"dial_attempts"`
+	DialBudget     int             `json:"dial_budget"`
+	// tell backends about the client, turns on http mode
+	ForwardedHeaders bool     `json:"forwarded_headers"`
+	TrustedProxies   []string `json:"trusted_proxies"`
+	// path prefixes sent to tagged backends, turn on http mode
+	Routes []Route `json:"routes"`
+	// send requests to backend groups by header or cookie, turn on http mode
+	Canary []CanaryRule `json:"canary"`
+	// keep clients on one backend, turns on http mode
+	Sticky *StickyConfig `json:"sticky"`
 }
 
 type BackendTmp struct {
-	Url            string `"json:url"`
-	ConnectTimeout int    `json:connect_timeout"`
+	Url            string       `json:"url"`
+	ConnectTimeout int          `json:"connect_timeout"`
+	Weight         int          `json:"weight"`
+	Priority       int          `json:"priority"`
+	Backup         bool         `json:"backup"`
+	SlowStart      int          `json:"slow_start"`
+	Draining       bool         `json:"draining"`
+	HealthCheck    *HealthCheck `json:"health_check"`
+	ProxyProtocol  string       `json:"proxy_protocol"`
+	Tags           []string     `json:"tags"`
+	Group          string       `json:"group"`
 }
 
 func ResolveApps(client *etcd.Client, etcdKey string) (map[string]*Frontend, map[string]*Frontend) {
@@ -58,7 +83,17 @@ func ResolveApps(client *etcd.Client, etcdKey string) (map[string]*Frontend, map
 
 			backends[appId] = append(backends[appId], backend)
 			app.Backends[backend.Id] = backend
-			collection.Backends[backendId] = backend
+			collection.SetBackend(backend)
+		}
+
+		if groupsEtcd, err := client.Get("/"+etcdKey+"/"+appId+"/groups", false, false); err == nil {
+			weights, err := groupWeightsFromJson(groupsEtcd.Node.Value)
+			if err == nil {
+				err = app.SetGroups(weights)
+			}
+			if err != nil {
+				log.Printf("Skip groups of %s due error: %s", appId, err)
+			}
 		}
 
 		frontendsEtcd, err := client.Get("/"+etcdKey+"/"+appId+"/frontends", true, false)
@@ -79,13 +114,14 @@ func ResolveApps(client *etcd.Client, etcdKey string) (map[string]*Frontend, map
 				continue
 			}
 			frontend.SetBackends(backends[appId])
+			frontend.SetGroupWeights(app.Groups)
 			frontendsApp[appId][frontend.Id] = frontend
 			frontends[frontend.Id] = frontend
 			app.Frontends[frontend.Id] = frontend
 			collection.Frontends[frontendId] = frontend
 		}
 
-		collection.Applications[appId] = app
+		collection.AddApplication(app)
 	}
 
 	return InitApplications(frontends)
@@ -94,11 +130,16 @@ func ResolveApps(client *etcd.Client, etcdKey string) (map[string]*Frontend, map
 func NewBackendFromJson(id, data string) (Backend, error) {
 	var tmp BackendTmp
 
-	backend := NewBackend(id)
 	if err := json.Unmarshal([]byte(data), &tmp); err != nil {
-		return backend, err
+		return NewBackend(id), err
 	}
 
+	return newBackendFromTmp(id, tmp)
+}
+
+func newBackendFromTmp(id string, tmp BackendTmp) (Backend, error) {
+	backend := NewBackend(id)
+
 	if tmp.Url == "" {
 		return backend, errors.New(fmt.Sprintf("Skip backend with incorrect url %s", id))
 	}
@@ -108,17 +149,53 @@ func NewBackendFromJson(id, data string) (Backend, error) {
 		backend.ConnectTimeout = tmp.ConnectTimeout
 	}
 
+	if tmp.Weight < 0 {
+		return backend, errors.New(fmt.Sprintf("Skip backend with negative weight %s", id))
+	}
+	if tmp.Weight != 0 {
+		backend.Weight = tmp.Weight
+	}
+
+	if tmp.Priority < 0 {
+		return backend, errors.New(fmt.Sprintf("Skip backend with negative priority %s", id))
+	}
+	backend.Priority = tmp.Priority
+	backend.Backup = tmp.Backup
+
+	if tmp.SlowStart > 0 {
+		backend.SlowStart = tmp.SlowStart
+	}
+	backend.SetDraining(tmp.Draining)
+
+	if tmp.HealthCheck != nil {
+		if err := tmp.HealthCheck.validate(); err != nil {
+			return backend, errors.New(fmt.Sprintf("Skip backend %s with incorrect health check: %s", id, err))
+		}
+		backend.HealthCheck = tmp.HealthCheck
+	}
+
+	if !validProxyProtocol(tmp.ProxyProtocol) {
+		return backend, errors.New(fmt.Sprintf("Skip backend %s with unknown proxy protocol %s", id, tmp.ProxyProtocol))
+	}
+	backend.ProxyProtocol = tmp.ProxyProtocol
+	backend.Tags = tmp.Tags
+	backend.Group = tmp.Group
+
 	return backend, nil
 }
 
 func newFrontendFromJson(id, data string) (*Frontend, error) {
 	var tmp FrontendTmp
 
-	frontend := NewFrontend(id)
 	if err := json.Unmarshal([]byte(data), &tmp); err != nil {
 		return nil, err
 	}
 
+	return newFrontendFromTmp(id, tmp)
+}
+
+func newFrontendFromTmp(id string, tmp FrontendTmp) (*Frontend, error) {
+	frontend := NewFrontend(id)
 	frontend.Hosts = tmp.Hosts
 
 	if tmp.TLSCrt != "" || tmp.TLSKey != "" {
@@ -126,11 +203,59 @@ func newFrontendFromJson(id, data string) (*Frontend, error) {
 		if err != nil {
 			return nil, err
 		}
+		frontend.TLSCrt = tmp.TLSCrt
+		frontend.TLSKey = tmp.TLSKey
+	}
+
+	switch tmp.Mode {
+	case "", modeTCP:
+	case modeHTTP:
+		frontend.Mode = modeHTTP
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown frontend mode %s", tmp.Mode))
 	}
 
+	if err := frontend.SetStrategy(tmp.Strategy, tmp.StrategyParams); err != nil {
+		return nil, err
+	}
+	if err := frontend.SetRoutes(tmp.Routes); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range tmp.Canary {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	frontend.Canary = tmp.Canary
+	frontend.Sticky = tmp.Sticky
+
+	if tmp.DialAttempts > 0 {
+		frontend.DialAttempts = tmp.DialAttempts
+	}
+	if tmp.DialBudget > 0 {
+		frontend.DialBudget = tmp.DialBudget
+	}
+
+	trusted, err := parseTrustedProxies(tmp.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	frontend.ForwardedHeaders = tmp.ForwardedHeaders
+	frontend.TrustedProxies = tmp.TrustedProxies
+	frontend.trustedNets = trusted
+
 	return frontend, nil
 }
 
+func groupWeightsFromJson(data string) (map[string]int, error) {
+	var weights map[string]int
+	if err := json.Unmarshal([]byte(data), &weights); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
 func InitApplications(frontends map[string]*Frontend) (map[string]*Frontend, map[string]*Frontend) {
 	secureFrontends := make(map[string]*Frontend)
 	insecureFrontends := make(map[string]*Frontend)
@@ -153,11 +278,34 @@ func isFrontend(r *etcd.Response) bool {
 	return strings.Contains(r.Node.Key, "frontends")
 }
 
+// isGroups reports whether the key holds the group weights of an app
+func isGroups(r *etcd.Response) bool {
+	parts := strings.Split(r.Node.Key, "/")
+	return len(parts) == 4 && parts[3] == "groups"
+}
+
+// etcd error code of a watch index older than the kept history
+const etcdEventIndexCleared = 401
+
 func watchApps(client *etcd.Client, etcdKey string, secureServer, insecureServer *Server) {
+	// resume every watch after the last event, the status keys the nodes
+	// keep writing must not push changes in between out of sight
+	var waitIndex uint64
 	for {
-		r, err := client.Watch("/"+etcdKey, 0, true, nil, nil)
+		r, err := client.Watch("/"+etcdKey, waitIndex, true, nil, nil)
 		if err != nil {
-			log.Printf("Incorrect json: %s", err)
+			if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdEventIndexCleared {
+				log.Printf("Missed changes of %s, etcd cleared the events since index %d", etcdKey, waitIndex)
+				waitIndex = etcdErr.Index + 1
+			} else {
+				log.Printf("Incorrect json: %s", err)
+			}
+			continue
+		}
+		waitIndex = r.Node.ModifiedIndex + 1
+
+		// health published by the proxy nodes, not configuration
+		if isStatus(r) {
 			continue
 		}
 
@@ -168,31 +316,35 @@ func watchApps(client *etcd.Client, etcdKey string, secureServer, insecureServer
 		}
 		appId := parts[2]
 		tmpId := r.Node.Key[strings.LastIndex(r.Node.Key, "/")+1:]
+		app, _ := collection.Application(appId)
 
 		if r.Action == "delete" {
-			if isBackend(r) {
-				collection.Applications[appId].DeleteBackend(tmpId)
-				delete(collection.Backends, tmpId)
+			if isGroups(r) {
+				collection.SetAppGroups(app, nil)
+			} else if isBackend(r) {
+				collection.DeleteAppBackend(app, tmpId)
 			} else if isFrontend(r) {
-				collection.Applications[appId].DeleteFrontend(tmpId)
-				delete(collection.Frontends, tmpId)
+				collection.DeleteAppFrontend(app, tmpId)
 			} else {
-				collection.Applications[appId].Stop()
-				delete(collection.Applications, appId)
+				collection.DeleteApplication(appId)
 			}
 		} else if r.Action == "set" || r.Action == "update" {
-			if isBackend(r) {
+			if isGroups(r) {
+				weights, err := groupWeightsFromJson(r.Node.Value)
+				if err == nil {
+					err = collection.SetAppGroups(app, weights)
+				}
+				if err != nil {
+					log.Printf("Skip groups of %s due error: %s", appId, err)
+				}
+			} else if isBackend(r) {
 				// Create / Update / Delete backend
 				backend, err := NewBackendFromJson(tmpId, r.Node.Value)
 				if err != nil {
 					log.Printf("Skip backend due error: %s", err)
 					continue
 				}
-				if _, ok := collection.Backends[tmpId]; ok {
-					collection.Applications[appId].DeleteBackend(tmpId)
-				}
-				collection.Backends[tmpId] = backend
-				collection.Applications[appId].AddBackend(backend)
+				collection.AddAppBackend(app, backend)
 			} else if isFrontend(r) {
 				// Create / Update / Delete frontend
 				frontend, err := newFrontendFromJson(tmpId, r.Node.Value)
@@ -201,16 +353,18 @@ func watchApps(client *etcd.Client, etcdKey string, secureServer, insecureServer
 					continue
 				}
 
-				var backendList []Backend
-				for _, back := range collection.Applications[appId].Backends {
-					backendList = append(backendList, back)
+				if existing, ok := collection.AppFrontend(app, tmpId); ok {
+					if existing.sameListeners(frontend) {
+						// listeners are the same, update the settings live
+						if err := existing.Update(frontend); err != nil {
+							log.Printf("Skip frontend %s:%s update: %s", appId, tmpId, err)
+						}
+						continue
+					}
+					collection.DeleteAppFrontend(app, tmpId)
 				}
-				frontend.SetBackends(backendList)
 
-				if _, ok := collection.Frontends[tmpId]; ok {
-					collection.Applications[appId].DeleteFrontend(tmpId)
-				}
-				collection.Frontends[tmpId] = frontend
+				collection.AddAppFrontend(app, frontend)
 
 				if frontend.isSecure() {
 					secureServer.AddFrontend(frontend)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// headers carrying the client of a request, dropped from requests of
+// untrusted peers
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// parseTrustedProxies parses a list of CIDRs or single addresses
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("Incorrect trusted proxy %s", proxy))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Incorrect trusted proxy %s", proxy))
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func isTrusted(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardHeaders tells the backend who the client of the request is. The
+// headers sent by trusted proxies are extended, the ones sent by anybody
+// else are replaced.
+func (f *Frontend) forwardHeaders(in, out *http.Request) {
+	f.lock.RLock()
+	trusted := f.trustedNets
+	f.lock.RUnlock()
+
+	clientIP := in.RemoteAddr
+	if host, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	for _, name := range forwardedHeaders {
+		out.Header.Del(name)
+	}
+
+	xff := clientIP
+	forwarded := forwardedElement(clientIP, in.Host, proto)
+	realIP := clientIP
+	if isTrusted(trusted, clientIP) {
+		if prior := strings.Join(in.Header["X-Forwarded-For"], ", "); prior != "" {
+			xff = prior + ", " + xff
+			realIP = lastUntrusted(trusted, xff)
+		}
+		if prior := strings.Join(in.Header["Forwarded"], ", "); prior != "" {
+			forwarded = prior + ", " + forwarded
+		}
+		if prior := in.Header.Get("X-Real-Ip"); prior != "" {
+			realIP = prior
+		}
+		if prior := in.Header.Get("X-Forwarded-Proto"); prior != "" {
+			proto = prior
+		}
+		if prior := in.Header.Get("X-Forwarded-Host"); prior != "" {
+			out.Header.Set("X-Forwarded-Host", prior)
+		}
+	}
+
+	out.Header.Set("X-Forwarded-For", xff)
+	out.Header.Set("X-Forwarded-Proto", proto)
+	if out.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+	out.Header.Set("X-Real-Ip", realIP)
+	out.Header.Set("Forwarded", forwarded)
+}
+
+// lastUntrusted returns the address closest to the proxy in a
+// X-Forwarded-For chain that was not added by a trusted proxy
+func lastUntrusted(trusted []*net.IPNet, xff string) string {
+	chain := strings.Split(xff, ",")
+	for i := len(chain) - 1; i > 0; i-- {
+		if !isTrusted(trusted, chain[i]) {
+			return strings.TrimSpace(chain[i])
+		}
+	}
+	return strings.TrimSpace(chain[0])
+}
+
+// forwardedElement formats a RFC 7239 Forwarded element
+func forwardedElement(clientIP, host, proto string) string {
+	node := clientIP
+	if strings.Contains(clientIP, ":") {
+		node = `"[` + clientIP + `]"`
+	}
+	return fmt.Sprintf("for=%s;host=%q;proto=%s", node, host, proto)
+}
@@ -1,44 +1,85 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var errDialBudget = errors.New("Dial budget exhausted")
+
 func NewFrontend(id string) *Frontend {
 	fr := &Frontend{
-		Id:   id,
-		ch:   make(chan bool),
-		wait: &sync.WaitGroup{},
-		// always round-robin strategy for now
-		strategy: &RoundRobinStrategy{},
+		Id:           id,
+		ch:           make(chan bool),
+		wait:         &sync.WaitGroup{},
+		Mode:         modeTCP,
+		Strategy:     defaultStrategy,
+		DialAttempts: defaultDialAttempts,
 	}
+	strategy, _ := newFrontendStrategy(defaultStrategy, nil, nil)
+	fr.strategy.Store(strategyHolder{strategy})
 
 	return fr
 }
 
 type Frontend struct {
-	Id     string   `json:"id"`
-	Hosts  []string `json:"hosts"`
-	TLSCrt string   `json:"tls_crt"`
-	TLSKey string   `json:"tls_key"`
-
-	strategy  BackendStrategy
-	tlsConfig *tls.Config
-	server    *Server
-	running   bool
+	Id             string          `json:"id"`
+	Hosts          []string        `json:"hosts"`
+	TLSCrt         string          `json:"tls_crt"`
+	TLSKey         string          `json:"tls_key"`
+	Mode           string          `json:"mode"`
+	Strategy       string          `json:"strategy"`
+	StrategyParams json.RawMessage `json:"strategy_params,omitempty"`
+	// path prefixes balanced over their own backends, turn on http mode
+	Routes []Route `json:"routes,omitempty"`
+	// requests sent to backend groups by header or cookie, turn on http mode
+	Canary []CanaryRule `json:"canary,omitempty"`
+	// keep clients on one backend with a cookie, turns on http mode
+	Sticky *StickyConfig `json:"sticky,omitempty"`
+	// backends to try before giving up on a connection
+	DialAttempts int `json:"dial_attempts"`
+	// total milliseconds all dial attempts may take, 0 for no limit
+	DialBudget int `json:"dial_budget"`
+	// tell backends about the client in X-Forwarded-* and Forwarded headers,
+	// turns on http mode
+	ForwardedHeaders bool `json:"forwarded_headers"`
+	// peers whose forwarded headers are kept and extended
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// serializes changes of the strategy and guards the settings that may
+	// change while connections are proxied
+	lock sync.RWMutex
+	// strategyHolder, swapped atomically so picks never wait for a change
+	strategy    atomic.Value
+	trustedNets []*net.IPNet
+	// traffic split between backend groups, set by the application
+	groupWeights map[string]int
+	tlsConfig    *tls.Config
+	server       *Server
+	running      bool
+	// serves the connections in http mode
+	http *httpProxy
 
 	hostListeners []net.Listener
 	ch            chan bool
 	wait          *sync.WaitGroup
 }
 
+// strategyHolder keeps the stored type of the atomic value the same for
+// every strategy implementation
+type strategyHolder struct {
+	BackendStrategy
+}
+
 func (s *Frontend) SetTLS(TLSCrt, TLSKey string) (err error) {
 	var cert, key []byte
 
@@ -61,24 +102,149 @@ func (s *Frontend) SetTLS(TLSCrt, TLSKey string) (err error) {
 	return nil
 }
 
+// SetStrategy replaces the balancing strategy of a running frontend. The
+// backends of the current strategy are carried over to the new one.
+func (f *Frontend) SetStrategy(name string, params json.RawMessage) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.setStrategy(name, params, f.Routes)
+}
+
+// SetRoutes replaces the routes of a running frontend
+func (f *Frontend) SetRoutes(routes []Route) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.setStrategy(f.Strategy, f.StrategyParams, routes)
+}
+
+// setStrategy rebuilds the strategies of the frontend if they changed,
+// f.lock must be held
+func (f *Frontend) setStrategy(name string, params json.RawMessage, routes []Route) error {
+	if name == "" {
+		name = defaultStrategy
+	}
+
+	current := f.currentStrategy()
+	if current != nil && name == f.Strategy && bytes.Equal(params, f.StrategyParams) && sameRoutes(routes, f.Routes) {
+		return nil
+	}
+
+	strategy, err := newFrontendStrategy(name, params, routes)
+	if err != nil {
+		return err
+	}
+
+	if current != nil {
+		strategy.SetBackends(current.Backends())
+	}
+	strategy.SetWeights(f.groupWeights)
+	f.strategy.Store(strategyHolder{strategy})
+	f.Strategy = name
+	f.StrategyParams = params
+	f.Routes = routes
+
+	return nil
+}
+
+// SetGroupWeights changes the traffic split between the backend groups
+func (f *Frontend) SetGroupWeights(weights map[string]int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.groupWeights = weights
+	if strategy, ok := f.currentStrategy().(*GroupStrategy); ok {
+		strategy.SetWeights(weights)
+	}
+}
+
+// newFrontendStrategy builds the strategies of a frontend: one per backend
+// group, each split by routes and priority tiers
+func newFrontendStrategy(name string, params json.RawMessage, routes []Route) (*GroupStrategy, error) {
+	// fail early on bad settings, every group is built the same way
+	if _, err := NewRouteStrategy(name, params, routes); err != nil {
+		return nil, err
+	}
+	return NewGroupStrategy(func() BackendStrategy {
+		group, _ := NewRouteStrategy(name, params, routes)
+		return group
+	}), nil
+}
+
+// Update applies the settings of other frontend, which must have the same
+// listeners, to the running frontend
+func (f *Frontend) Update(other *Frontend) error {
+	warnStickySecret(other)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.setStrategy(other.Strategy, other.StrategyParams, other.Routes); err != nil {
+		return err
+	}
+
+	f.DialAttempts = other.DialAttempts
+	f.DialBudget = other.DialBudget
+	f.ForwardedHeaders = other.ForwardedHeaders
+	f.TrustedProxies = other.TrustedProxies
+	f.trustedNets = other.trustedNets
+	f.Canary = other.Canary
+	f.Sticky = other.Sticky
+
+	return nil
+}
+
+// sameListeners reports whether other frontend listens on the same hosts
+// with the same certificate and mode, so it can be updated without a restart
+func (f *Frontend) sameListeners(other *Frontend) bool {
+	if f.TLSCrt != other.TLSCrt || f.TLSKey != other.TLSKey || f.isHTTP() != other.isHTTP() || len(f.Hosts) != len(other.Hosts) {
+		return false
+	}
+
+	for i, host := range f.Hosts {
+		if other.Hosts[i] != host {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *Frontend) currentStrategy() BackendStrategy {
+	holder, _ := f.strategy.Load().(strategyHolder)
+	return holder.BackendStrategy
+}
+
+func (f *Frontend) nextBackend(sel *Selection) (Backend, error) {
+	return f.currentStrategy().NextBackend(sel)
+}
+
 func (f *Frontend) AddBackend(backend Backend) {
 	f.server.Printf("Add new backend: %s", backend.Id)
-	f.strategy.AddBackend(backend)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.currentStrategy().AddBackend(backend)
 }
 
 func (f *Frontend) DeleteBackend(id string) error {
 	f.server.Printf("Delete backend: %s", id)
-	return f.strategy.DeleteBackend(id)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.currentStrategy().DeleteBackend(id)
 }
 
 func (f *Frontend) SetBackends(backends []Backend) {
-	f.strategy.SetBackends(backends)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.currentStrategy().SetBackends(backends)
 }
 
 func (f *Frontend) isSecure() bool {
 	return f.tlsConfig != nil
 }
 
+func (f *Frontend) isHTTP() bool {
+	return f.Mode == modeHTTP || f.ForwardedHeaders || len(f.Routes) > 0 || len(f.Canary) > 0 || f.Sticky != nil
+}
+
 func (s *Frontend) Start() error {
 	if s.running {
 		s.server.Printf("Frontend already started")
@@ -89,6 +255,11 @@ func (s *Frontend) Start() error {
 	s.running = true
 	s.ch = make(chan bool)
 
+	if s.isHTTP() {
+		s.http = newHTTPProxy(s)
+		go s.http.Serve()
+	}
+
 	s.wait.Add(len(s.Hosts))
 
 	go func() {
@@ -99,6 +270,9 @@ func (s *Frontend) Start() error {
 				for i := 0; i < len(s.Hosts); i++ {
 					s.wait.Done()
 				}
+				if s.http != nil {
+					s.http.Close()
+				}
 				for _, lh := range s.hostListeners {
 					err := lh.Close()
 					if lhErr, ok := err.(*net.OpError); ok {
@@ -195,18 +369,22 @@ Location: https://%s
 		}
 	}
 
-	// pick the backend
-	backend, err := s.strategy.NextBackend()
-	if err != nil {
+	// requests are balanced one by one
+	if s.http != nil {
+		s.http.listener.push(c)
+		return nil
+	}
+
+	// pick and dial the backend
+	sel := &Selection{ClientAddr: c.RemoteAddr().String()}
+	upConn, backend, err := s.dialBackend(sel)
+	if err != nil && len(sel.tried) == 0 {
 		s.server.Printf("Error: %s", err)
 		c.Close()
 		return nil
 	}
-
-	// dial the backend
-	upConn, err := net.DialTimeout("tcp", backend.Url, time.Duration(backend.ConnectTimeout)*time.Millisecond)
 	if err != nil {
-		s.server.Printf("Failed to dial backend connection %v: %v", backend.Url, err)
+		s.server.Printf("Failed to dial %d backends: %v", len(sel.tried), err)
 		if s.server.ErrorPage502 != "" {
 			fmt.Fprintf(c, `HTTP/1.0 502
 Content-Length: %d
@@ -220,12 +398,90 @@ Content-Type: text/html; charset=utf-8
 	}
 	s.server.Printf("Initiated new connection to backend: %s %s", upConn.LocalAddr(), upConn.RemoteAddr())
 
+	if err := writeProxyHeader(upConn, backend.ProxyProtocol, c.RemoteAddr(), c.LocalAddr()); err != nil {
+		s.server.Printf("Failed to send proxy protocol header to %v: %v", backend.Url, err)
+		upConn.Close()
+		c.Close()
+		return err
+	}
+
 	// join the connections
+	backend.connOpened()
+	defer backend.connClosed()
 	s.joinConnections(c, upConn)
 
 	return nil
 }
 
+// dialBackend dials backends picked by the strategy until one answers. Every
+// backend is tried at most once, within the attempts and time budget of the
+// frontend.
+func (s *Frontend) dialBackend(sel *Selection) (net.Conn, Backend, error) {
+	s.lock.RLock()
+	attempts, budget := s.DialAttempts, s.DialBudget
+	s.lock.RUnlock()
+
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var deadline time.Time
+	if budget > 0 {
+		deadline = time.Now().Add(time.Duration(budget) * time.Millisecond)
+	}
+
+	var lastErr error
+	for attempts > 0 {
+		backend, err := s.nextBackend(sel)
+		if err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			break
+		}
+
+		timeout := time.Duration(backend.ConnectTimeout) * time.Millisecond
+		if !deadline.IsZero() {
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				if lastErr == nil {
+					lastErr = errDialBudget
+				}
+				break
+			}
+			if left < timeout {
+				timeout = left
+			}
+		}
+
+		// the half-open circuit has all its trials in flight, try another one
+		allowed, trial := s.server.Breaker.Acquire(backend)
+		if !allowed {
+			sel.tried = append(sel.tried, backend.Id)
+			if lastErr == nil {
+				lastErr = errCircuitOpen
+			}
+			continue
+		}
+		attempts--
+
+		dialStart := time.Now()
+		conn, err := net.DialTimeout("tcp", backend.Url, timeout)
+		s.server.Breaker.Record(backend, trial, err == nil)
+		if err == nil {
+			backend.dialSucceeded(time.Since(dialStart))
+			return conn, backend, nil
+		}
+
+		s.server.Outliers.DialFailed(backend, s.currentStrategy().Backends())
+		s.server.Printf("Failed to dial backend connection %v: %v", backend.Url, err)
+		sel.tried = append(sel.tried, backend.Id)
+		lastErr = err
+	}
+
+	return nil, Backend{}, lastErr
+}
+
 func (s *Frontend) joinConnections(c1 net.Conn, c2 net.Conn) {
 	var wg sync.WaitGroup
 	halfJoin := func(dst net.Conn, src net.Conn) {
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFrontend(t *testing.T, backends ...Backend) *Frontend {
+	f := NewFrontend("f1")
+	f.server = &Server{Logger: log.New(ioutil.Discard, "", 0)}
+	f.SetBackends(backends)
+	return f
+}
+
+// deadBackend returns a backend with an address nobody listens on
+func deadBackend(t *testing.T, id string) Backend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := NewBackend(id)
+	backend.Url = l.Addr().String()
+	l.Close()
+	return backend
+}
+
+func liveBackend(t *testing.T, id string) (Backend, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := NewBackend(id)
+	backend.Url = l.Addr().String()
+	return backend, l
+}
+
+func TestDialBackendRetries(t *testing.T) {
+	live, l := liveBackend(t, "live")
+	defer l.Close()
+	f := newTestFrontend(t, deadBackend(t, "dead1"), deadBackend(t, "dead2"), live)
+
+	for i := 0; i < 3; i++ {
+		sel := &Selection{ClientAddr: "10.0.0.1:5000"}
+		conn, backend, err := f.dialBackend(sel)
+		if err != nil {
+			t.Fatalf("Expected retries to reach the live backend: %v", err)
+		}
+		conn.Close()
+		if backend.Id != "live" {
+			t.Fatalf("Expected live backend, got %s", backend.Id)
+		}
+	}
+
+	f.DialAttempts = 1
+	f.SetBackends([]Backend{deadBackend(t, "dead3"), deadBackend(t, "dead4")})
+	sel := &Selection{ClientAddr: "10.0.0.1:5000"}
+	if _, _, err := f.dialBackend(sel); err == nil {
+		t.Fatalf("Expected dial error")
+	}
+	if len(sel.tried) != 1 {
+		t.Fatalf("Expected a single attempt, got %d", len(sel.tried))
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{ConsecutiveFailures: 3, BaseEjection: 1000, MaxEjection: 3000, MaxEjectedPercent: 50})
+
+	pool := []Backend{NewBackend("b1"), NewBackend("b2"), NewBackend("b3"), NewBackend("b4")}
+	b1, b2, b3 := pool[0], pool[1], pool[2]
+
+	d.DialFailed(b1, pool)
+	d.DialFailed(b1, pool)
+	if b1.Ejected() {
+		t.Fatalf("Backend ejected before the threshold")
+	}
+	d.DialFailed(b1, pool)
+	if !b1.Ejected() || b1.Available() {
+		t.Fatalf("Backend not ejected after 3 failures")
+	}
+
+	// a success in between resets the count
+	for i := 0; i < 2; i++ {
+		d.DialFailed(b2, pool)
+	}
+	b2.dialSucceeded(time.Millisecond)
+	d.DialFailed(b2, pool)
+	if b2.Ejected() {
+		t.Fatalf("Backend ejected without failing 3 dials in a row")
+	}
+	for i := 0; i < 2; i++ {
+		d.DialFailed(b2, pool)
+	}
+	if !b2.Ejected() {
+		t.Fatalf("Backend not ejected")
+	}
+
+	// half of the pool is out, the third one stays
+	for i := 0; i < 5; i++ {
+		d.DialFailed(b3, pool)
+	}
+	if b3.Ejected() {
+		t.Fatalf("Ejected more than the allowed share of backends")
+	}
+
+	// the next ejection lasts twice as long
+	b1.stats.ejectedUntil = time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		d.DialFailed(b1, pool)
+	}
+	second := time.Duration(b1.stats.ejectedUntil - time.Now().UnixNano())
+	if second < 1500*time.Millisecond || second > 2*time.Second {
+		t.Fatalf("Expected second ejection of about 2s, got %s", second)
+	}
+}
+
+func TestOutlierDetectionKeepsLastBackend(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{ConsecutiveFailures: 1, MaxEjectedPercent: 50})
+
+	// the cap of a single backend rounds down to 0
+	single := NewBackend("single")
+	d.DialFailed(single, []Backend{single})
+	if single.Ejected() {
+		t.Fatalf("Ejected the only backend")
+	}
+
+	pool := []Backend{NewBackend("b1"), NewBackend("b2")}
+	d.DialFailed(pool[0], pool)
+	d.DialFailed(pool[1], pool)
+	if !pool[0].Ejected() || pool[1].Ejected() {
+		t.Fatalf("Expected only the first of 2 backends ejected")
+	}
+
+	// even with no cap the last available backend stays
+	d.MaxEjectedPercent = 100
+	d.DialFailed(pool[1], pool)
+	if pool[1].Ejected() {
+		t.Fatalf("Ejected the last available backend")
+	}
+
+	down := NewBackend("down")
+	down.setHealthy(false)
+	pool = []Backend{NewBackend("b3"), down}
+	d.DialFailed(pool[0], pool)
+	if pool[0].Ejected() {
+		t.Fatalf("Ejected the last healthy backend")
+	}
+}
+
+// run with -race
+func TestOutlierDetectionConcurrentFailures(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{ConsecutiveFailures: 1, MaxEjectedPercent: 100})
+
+	for round := 0; round < 100; round++ {
+		pool := []Backend{NewBackend("b1"), NewBackend("b2")}
+
+		var wg sync.WaitGroup
+		start := make(chan bool)
+		for _, backend := range pool {
+			wg.Add(1)
+			go func(backend Backend) {
+				defer wg.Done()
+				<-start
+				d.DialFailed(backend, pool)
+			}(backend)
+		}
+		close(start)
+		wg.Wait()
+
+		if pool[0].Ejected() && pool[1].Ejected() {
+			t.Fatalf("Both backends ejected by failures at the same time")
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureRate: 50, MinRequests: 4, Window: 10000, OpenTimeout: 50, HalfOpenTrials: 2})
+	b := NewBackend("b1")
+	allowed := func() bool {
+		ok, _ := cb.Acquire(b)
+		return ok
+	}
+
+	for _, ok := range []bool{true, false, true} {
+		_, trial := cb.Acquire(b)
+		cb.Record(b, trial, ok)
+	}
+	if b.CircuitState() != "closed" {
+		t.Fatalf("Circuit opened below min requests")
+	}
+	// a slow connection started while closed
+	_, slow := cb.Acquire(b)
+	_, trial := cb.Acquire(b)
+	cb.Record(b, trial, false)
+	if b.CircuitState() != "open" || b.Available() || allowed() {
+		t.Fatalf("Circuit not opened at 50%% failures")
+	}
+
+	// after the open timeout only the trials get through
+	time.Sleep(60 * time.Millisecond)
+	if !b.Available() {
+		t.Fatalf("Open circuit kept the backend out after the timeout")
+	}
+	_, first := cb.Acquire(b)
+	_, second := cb.Acquire(b)
+	if first == 0 || second == 0 || allowed() {
+		t.Fatalf("Expected exactly 2 trials through the half-open circuit")
+	}
+	if b.CircuitState() != "half_open" {
+		t.Fatalf("Expected half-open circuit, got %s", b.CircuitState())
+	}
+
+	// the slow connection finishing is no trial
+	cb.Record(b, slow, true)
+	cb.Record(b, first, true)
+	if b.CircuitState() != "half_open" || allowed() {
+		t.Fatalf("Connection started while closed counted as a trial")
+	}
+	cb.Record(b, second, false)
+	if b.CircuitState() != "open" {
+		t.Fatalf("Failed trial did not reopen the circuit")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, trial := cb.Acquire(b)
+		cb.Record(b, trial, true)
+	}
+	if b.CircuitState() != "closed" {
+		t.Fatalf("Successful trials did not close the circuit")
+	}
+}
+
+func TestBreakerRefusalFailsDial(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureRate: 50, MinRequests: 1, Window: 10000, OpenTimeout: 1, HalfOpenTrials: 1})
+
+	// half-open circuits with their trial in flight, available but refused
+	var backends []Backend
+	for i := 0; i < 200; i++ {
+		backend := deadBackend(t, fmt.Sprintf("b%d", i))
+		_, trial := cb.Acquire(backend)
+		cb.Record(backend, trial, false)
+		backends = append(backends, backend)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for _, backend := range backends {
+		if ok, _ := cb.Acquire(backend); !ok {
+			t.Fatalf("Expected a trial through the half-open circuit")
+		}
+		if ok, _ := cb.Acquire(backend); ok {
+			t.Fatalf("Expected a single trial through the half-open circuit")
+		}
+	}
+
+	f := newTestFrontend(t, backends...)
+	f.server.Breaker = cb
+	f.DialAttempts = 3
+
+	conn, _, err := f.dialBackend(&Selection{})
+	if conn != nil || err != errCircuitOpen {
+		t.Fatalf("Expected circuit open error, got %v", err)
+	}
+
+	// the budget runs out while refused backends are skipped
+	f.DialBudget = 1
+	for i := 0; i < 10; i++ {
+		if conn, _, err := f.dialBackend(&Selection{}); conn == nil && err == nil {
+			t.Fatalf("Expected an error without a connection")
+		}
+	}
+
+	f.DialBudget = 0
+	l := serveHTTPFrontend(t, f)
+	defer l.Close()
+	defer f.http.Close()
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 when every breaker refuses, got %d", resp.StatusCode)
+	}
+}
+
+// serveHTTPFrontend proxies the connections to the returned listener
+// through the frontend in http mode
+func serveHTTPFrontend(t *testing.T, f *Frontend) net.Listener {
+	f.http = newHTTPProxy(f)
+	go f.http.Serve()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.proxyConnection("example.com", c)
+		}
+	}()
+	return l
+}
+
+func TestHTTPMode(t *testing.T) {
+	var backends []Backend
+	newConns := make(map[string]int)
+	var mu sync.Mutex
+	for _, id := range []string{"b1", "b2"} {
+		id := id
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, id)
+		}))
+		ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				mu.Lock()
+				newConns[id]++
+				mu.Unlock()
+			}
+		}
+		ts.Start()
+		defer ts.Close()
+
+		backend := NewBackend(id)
+		backend.Url = ts.Listener.Addr().String()
+		backends = append(backends, backend)
+	}
+
+	f := newTestFrontend(t, backends...)
+	f.Mode = modeHTTP
+	l := serveHTTPFrontend(t, f)
+	defer l.Close()
+	defer f.http.Close()
+
+	get := func() (int, string) {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// a keep-alive client is balanced request by request
+	var got []string
+	for i := 0; i < 6; i++ {
+		_, body := get()
+		got = append(got, body)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] == got[i-1] {
+			t.Fatalf("Requests were not balanced: %v", got)
+		}
+	}
+	mu.Lock()
+	if newConns["b1"] != 1 || newConns["b2"] != 1 {
+		t.Fatalf("Backend connections were not reused: %v", newConns)
+	}
+	mu.Unlock()
+
+	// failed dials are retried on the next backend
+	f.SetBackends([]Backend{deadBackend(t, "dead"), backends[0]})
+	for i := 0; i < 4; i++ {
+		if status, body := get(); status != 200 || body != "b1" {
+			t.Fatalf("Expected retry to b1, got %d %s", status, body)
+		}
+	}
+
+	f.SetBackends(nil)
+	if status, _ := get(); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 without backends, got %d", status)
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	f := NewFrontend("f1")
+	f.trustedNets, _ = parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+
+	forward := func(remoteAddr string, header http.Header) http.Header {
+		in := httptest.NewRequest("GET", "http://example.com/", nil)
+		in.RemoteAddr = remoteAddr
+		for name, values := range header {
+			in.Header[name] = values
+		}
+		out := in.Clone(in.Context())
+		f.forwardHeaders(in, out)
+		return out.Header
+	}
+
+	// spoofed headers of a client are replaced
+	h := forward("203.0.113.7:5000", http.Header{
+		"X-Forwarded-For": {"1.2.3.4"},
+		"X-Real-Ip":       {"1.2.3.4"},
+		"Forwarded":       {"for=1.2.3.4"},
+	})
+	if h.Get("X-Forwarded-For") != "203.0.113.7" || h.Get("X-Real-Ip") != "203.0.113.7" {
+		t.Fatalf("Spoofed client address was kept: %v", h)
+	}
+	if h.Get("Forwarded") != `for=203.0.113.7;host="example.com";proto=http` {
+		t.Fatalf("Unexpected Forwarded header %q", h.Get("Forwarded"))
+	}
+	if h.Get("X-Forwarded-Proto") != "http" || h.Get("X-Forwarded-Host") != "example.com" {
+		t.Fatalf("Unexpected forwarded proto or host: %v", h)
+	}
+
+	// headers of a trusted proxy are extended
+	h = forward("10.1.2.3:5000", http.Header{
+		"X-Forwarded-For":   {"1.2.3.4, 198.51.100.1", "192.168.1.1"},
+		"X-Forwarded-Proto": {"https"},
+	})
+	if h.Get("X-Forwarded-For") != "1.2.3.4, 198.51.100.1, 192.168.1.1, 10.1.2.3" {
+		t.Fatalf("Chain of trusted proxy not extended: %q", h.Get("X-Forwarded-For"))
+	}
+	if h.Get("X-Real-Ip") != "198.51.100.1" || h.Get("X-Forwarded-Proto") != "https" {
+		t.Fatalf("Unexpected client of trusted proxy: %v", h)
+	}
+
+	h = forward("[2001:db8::1]:5000", nil)
+	if h.Get("Forwarded") != `for="[2001:db8::1]";host="example.com";proto=http` {
+		t.Fatalf("Unexpected Forwarded header %q", h.Get("Forwarded"))
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("Expected error for incorrect CIDR")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	backend, bl := liveBackend(t, "b1")
+	defer bl.Close()
+	backend.ProxyProtocol = proxyProtocolV1
+	f := newTestFrontend(t, backend)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			f.proxyConnection("example.com", c)
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+
+	up, err := bl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	up.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 128)
+	n, _ := io.ReadAtLeast(up, buf, 10)
+	for n < len(buf) && !strings.HasSuffix(string(buf[:n]), "hello") {
+		m, err := up.Read(buf[n:])
+		if err != nil {
+			break
+		}
+		n += m
+	}
+
+	src := client.LocalAddr().(*net.TCPAddr)
+	dst := client.RemoteAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\nhello", src.Port, dst.Port)
+	if string(buf[:n]) != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf[:n])
+	}
+
+	header := proxyHeaderV2(
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000},
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443})
+	v2 := append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0, 12, 192, 0, 2, 1, 192, 0, 2, 2, 0x13, 0x88, 0x01, 0xbb)
+	if !bytes.Equal(header, v2) {
+		t.Fatalf("Unexpected v2 header % x", header)
+	}
+
+	if _, err := NewBackendFromJson("b2", `{"url": "127.0.0.1:80", "proxy_protocol": "v3"}`); err == nil {
+		t.Fatalf("Expected error for unknown proxy protocol")
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	var backends []Backend
+	for _, id := range []string{"b1", "b2", "b3"} {
+		id := id
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, id)
+		}))
+		defer ts.Close()
+
+		backend := NewBackend(id)
+		backend.Url = ts.Listener.Addr().String()
+		backends = append(backends, backend)
+	}
+
+	f := newTestFrontend(t, backends...)
+	f.server.StickySecret = []byte("secret")
+	f.Sticky = &StickyConfig{}
+	l := serveHTTPFrontend(t, f)
+	defer l.Close()
+	defer f.http.Close()
+
+	get := func(cookie string) (string, string) {
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", defaultStickyCookie+"="+cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		set := ""
+		for _, c := range resp.Cookies() {
+			if c.Name == defaultStickyCookie {
+				set = c.Value
+			}
+		}
+		return string(body), set
+	}
+
+	first, cookie := get("")
+	if cookie == "" {
+		t.Fatalf("No sticky cookie set on the first response")
+	}
+	for i := 0; i < 6; i++ {
+		body, set := get(cookie)
+		if body != first || set != "" {
+			t.Fatalf("Expected %s without a new cookie, got %s %q", first, body, set)
+		}
+	}
+
+	// forged cookies fall back to the strategy
+	other := "b1"
+	if first == "b1" {
+		other = "b2"
+	}
+	picked := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		body, _ := get(other + ".forged")
+		picked[body] = true
+	}
+	if len(picked) < 2 {
+		t.Fatalf("Forged cookie pinned the backend: %v", picked)
+	}
+
+	// a draining backend loses its sessions to another one
+	for _, backend := range backends {
+		if backend.Id == first {
+			backend.SetDraining(true)
+		}
+	}
+	body, set := get(cookie)
+	if body == first || set == "" || set == cookie {
+		t.Fatalf("Expected a new backend and cookie after draining, got %s %q", body, set)
+	}
+}
+
+func TestStickySessionsRoutesAndCanary(t *testing.T) {
+	var backends []Backend
+	for _, id := range []string{"api", "web", "canary"} {
+		id := id
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, id)
+		}))
+		defer ts.Close()
+
+		backend := NewBackend(id)
+		backend.Url = ts.Listener.Addr().String()
+		backends = append(backends, backend)
+	}
+	backends[0].Tags = []string{"api"}
+	backends[2].Group = "canary"
+
+	f := newTestFrontend(t, backends...)
+	if err := f.SetRoutes([]Route{{Path: "/api/", Tags: []string{"api"}}}); err != nil {
+		t.Fatal(err)
+	}
+	f.Canary = []CanaryRule{{Header: "X-Canary", Group: "canary"}}
+	f.server.StickySecret = []byte("secret")
+	f.Sticky = &StickyConfig{}
+	l := serveHTTPFrontend(t, f)
+	defer l.Close()
+	defer f.http.Close()
+
+	get := func(path, cookie string, canary bool) (string, string) {
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+path, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", defaultStickyCookie+"="+cookie)
+		}
+		if canary {
+			req.Header.Set("X-Canary", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		set := ""
+		for _, c := range resp.Cookies() {
+			if c.Name == defaultStickyCookie {
+				set = c.Value
+			}
+		}
+		return string(body), set
+	}
+
+	body, apiCookie := get("/api/users", "", false)
+	if body != "api" || apiCookie == "" {
+		t.Fatalf("Expected api backend with a cookie, got %s %q", body, apiCookie)
+	}
+	if body, set := get("/api/orders", apiCookie, false); body != "api" || set != "" {
+		t.Fatalf("Expected api backend without a new cookie, got %s %q", body, set)
+	}
+
+	// the cookie of the api route doesn't take other paths there
+	body, webCookie := get("/static/app.js", apiCookie, false)
+	if body != "web" || webCookie == "" {
+		t.Fatalf("Expected web backend and a new cookie, got %s %q", body, webCookie)
+	}
+
+	// nor does a stable cookie keep canary requests out of their group
+	if body, _ := get("/", webCookie, true); body != "canary" {
+		t.Fatalf("Expected canary backend, got %s", body)
+	}
+	if body, _ := get("/", webCookie, false); body != "web" {
+		t.Fatalf("Expected web backend, got %s", body)
+	}
+}
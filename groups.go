@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// group of the regular backends, the ones that don't set one
+const defaultGroup = "default"
+
+// CanaryRule sends the requests carrying a header or cookie to a backend
+// group
+type CanaryRule struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+	// value to match, any value if empty
+	Value string `json:"value,omitempty"`
+	Group string `json:"group"`
+}
+
+func (r CanaryRule) validate() error {
+	if (r.Header == "") == (r.Cookie == "") {
+		return errors.New("Canary rule needs either a header or a cookie")
+	}
+	if r.Group == "" {
+		return errors.New(fmt.Sprintf("Canary rule %s%s has no group", r.Header, r.Cookie))
+	}
+	return nil
+}
+
+func (r CanaryRule) matches(req *http.Request) bool {
+	if r.Header != "" {
+		if _, ok := req.Header[http.CanonicalHeaderKey(r.Header)]; !ok {
+			return false
+		}
+		return r.Value == "" || req.Header.Get(r.Header) == r.Value
+	}
+
+	cookie, err := req.Cookie(r.Cookie)
+	if err != nil {
+		return false
+	}
+	return r.Value == "" || cookie.Value == r.Value
+}
+
+// canaryGroup returns the group of the first canary rule matching req
+func canaryGroup(rules []CanaryRule, req *http.Request) string {
+	for _, rule := range rules {
+		if rule.matches(req) {
+			return rule.Group
+		}
+	}
+	return ""
+}
+
+// validateGroupWeights checks the traffic split of an application
+func validateGroupWeights(weights map[string]int) error {
+	total := 0
+	for name, weight := range weights {
+		if weight < 0 {
+			return errors.New(fmt.Sprintf("Negative weight of group %s", name))
+		}
+		total += weight
+	}
+	if len(weights) > 0 && total == 0 {
+		return errors.New("Every group weight is 0")
+	}
+	return nil
+}
+
+type groupWeight struct {
+	name   string
+	weight int
+}
+
+// groupSplit is the immutable traffic split of a GroupStrategy
+type groupSplit struct {
+	// heaviest first
+	groups []groupWeight
+	total  int
+}
+
+// GroupStrategy balances every backend group with its own strategy. The
+// connections not sent to a group are split by the group weights, or go to
+// the regular backends without weights. When the group has no available
+// backend the other weighted groups are tried, then the regular backends.
+type GroupStrategy struct {
+	mu       sync.Mutex
+	newGroup func() BackendStrategy
+	// map[string]BackendStrategy, copy-on-write
+	groups atomic.Value
+	split  atomic.Value // groupSplit
+}
+
+func NewGroupStrategy(newGroup func() BackendStrategy) *GroupStrategy {
+	s := &GroupStrategy{newGroup: newGroup}
+	s.groups.Store(map[string]BackendStrategy{})
+	s.split.Store(groupSplit{})
+	return s
+}
+
+func (s *GroupStrategy) load() map[string]BackendStrategy {
+	groups, _ := s.groups.Load().(map[string]BackendStrategy)
+	return groups
+}
+
+// SetWeights changes the share of the connections of every group, in any
+// unit, nil sends everything to the regular backends
+func (s *GroupStrategy) SetWeights(weights map[string]int) {
+	var split groupSplit
+	for name, weight := range weights {
+		if weight > 0 {
+			split.groups = append(split.groups, groupWeight{name, weight})
+			split.total += weight
+		}
+	}
+	sort.Slice(split.groups, func(i, j int) bool {
+		a, b := split.groups[i], split.groups[j]
+		return a.weight > b.weight || (a.weight == b.weight && a.name < b.name)
+	})
+	s.split.Store(split)
+}
+
+// candidates returns the groups to try for a connection in order, a group
+// may repeat
+func (s *GroupStrategy) candidates(sel *Selection) []string {
+	split := s.split.Load().(groupSplit)
+	order := make([]string, 0, len(split.groups)+2)
+
+	if sel != nil && sel.Group != "" {
+		order = append(order, sel.Group)
+	} else if split.total > 0 {
+		n := randIntn(split.total)
+		for _, g := range split.groups {
+			if n < g.weight {
+				order = append(order, g.name)
+				break
+			}
+			n -= g.weight
+		}
+	}
+
+	for _, g := range split.groups {
+		order = append(order, g.name)
+	}
+	return append(order, defaultGroup)
+}
+
+func (s *GroupStrategy) NextBackend(sel *Selection) (Backend, error) {
+	groups := s.load()
+
+	for _, name := range s.candidates(sel) {
+		strategy, ok := groups[name]
+		if !ok {
+			continue
+		}
+		if backend, err := strategy.NextBackend(sel); err == nil {
+			return backend, nil
+		}
+	}
+	return Backend{}, errNoBackends
+}
+
+// backendsFor returns the backends of the group of sel, or of every group
+// when it has none
+func (s *GroupStrategy) backendsFor(sel *Selection) []Backend {
+	groups := s.load()
+	if sel != nil && sel.Group != "" {
+		if strategy, ok := groups[sel.Group]; ok {
+			return selectableBackends(strategy, sel)
+		}
+		return nil
+	}
+
+	var backends []Backend
+	for _, strategy := range groups {
+		backends = append(backends, selectableBackends(strategy, sel)...)
+	}
+	return backends
+}
+
+// group returns the strategy of a group, adding it if needed, s.mu must be
+// held
+func (s *GroupStrategy) group(name string) BackendStrategy {
+	groups := s.load()
+	if strategy, ok := groups[name]; ok {
+		return strategy
+	}
+
+	strategy := s.newGroup()
+	next := make(map[string]BackendStrategy, len(groups)+1)
+	for k, v := range groups {
+		next[k] = v
+	}
+	next[name] = strategy
+	s.groups.Store(next)
+	return strategy
+}
+
+func (s *GroupStrategy) AddBackend(backend Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group(backend.group()).AddBackend(backend)
+}
+
+func (s *GroupStrategy) DeleteBackend(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := errors.New(fmt.Sprintf("Unknown backend id: %s", id))
+	for _, strategy := range s.load() {
+		if strategy.DeleteBackend(id) == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (s *GroupStrategy) SetBackends(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets := make(map[string][]Backend)
+	for _, backend := range backends {
+		sets[backend.group()] = append(sets[backend.group()], backend)
+	}
+	for name := range s.load() {
+		if _, ok := sets[name]; !ok {
+			sets[name] = nil
+		}
+	}
+	for name, set := range sets {
+		s.group(name).SetBackends(set)
+	}
+}
+
+// Backends returns the backends of all groups, sorted by group
+func (s *GroupStrategy) Backends() []Backend {
+	groups := s.load()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var backends []Backend
+	for _, name := range names {
+		backends = append(backends, groups[name].Backends()...)
+	}
+	return backends
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckInterval = 5000 // milliseconds
+	defaultCheckTimeout  = 2000 // milliseconds
+	defaultCheckRise     = 2
+	defaultCheckFall     = 3
+
+	// how much of a response body is searched for the expected text
+	maxCheckBody = 64 * 1024
+)
+
+type HealthCheckConfig struct {
+	Interval int `json:"interval"` // milliseconds
+	Timeout  int `json:"timeout"`  // milliseconds
+	// consecutive successes to bring a backend back
+	Rise int `json:"rise"`
+	// consecutive failures to take a backend out of rotation
+	Fall int `json:"fall"`
+}
+
+// HealthCheck describes how a backend is probed
+type HealthCheck struct {
+	Type string `json:"type"` // tcp (default) or http
+
+	// tcp checks, payload to send after connect and a regexp the response
+	// must match, e.g. "PING\r\n" and "^\\+PONG", or only a banner regexp
+	Send   string `json:"send,omitempty"`
+	Expect string `json:"expect,omitempty"`
+	// the same for binary protocols in hex, the response must start with
+	// the expected bytes
+	SendHex   string `json:"send_hex,omitempty"`
+	ExpectHex string `json:"expect_hex,omitempty"`
+
+	// http checks
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	// accepted status codes, 200-399 if empty
+	Status []StatusRange `json:"status,omitempty"`
+	// text the response body must contain
+	Body string `json:"body,omitempty"`
+
+	send        []byte
+	expect      *regexp.Regexp
+	expectBytes []byte
+}
+
+// StatusRange is an inclusive range of HTTP status codes, written in json
+// as a single code (200) or a range ("200-299")
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+func (r *StatusRange) UnmarshalJSON(data []byte) error {
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		r.Min, r.Max = code, code
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(str, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Incorrect status %q", str))
+	}
+	r.Min, r.Max = min, min
+
+	if len(parts) == 2 {
+		if r.Max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return errors.New(fmt.Sprintf("Incorrect status %q", str))
+		}
+	}
+
+	return nil
+}
+
+func (r StatusRange) MarshalJSON() ([]byte, error) {
+	if r.Min == r.Max {
+		return json.Marshal(r.Min)
+	}
+	return json.Marshal(fmt.Sprintf("%d-%d", r.Min, r.Max))
+}
+
+func (hc *HealthCheck) validate() error {
+	switch hc.Type {
+	case "", "tcp":
+		if hc.Send != "" && hc.SendHex != "" {
+			return errors.New("only one of send and send_hex can be set")
+		}
+		if hc.Expect != "" && hc.ExpectHex != "" {
+			return errors.New("only one of expect and expect_hex can be set")
+		}
+		if (hc.Send != "" || hc.SendHex != "") && hc.Expect == "" && hc.ExpectHex == "" {
+			return errors.New("send needs an expect pattern")
+		}
+
+		hc.send = []byte(hc.Send)
+		if hc.SendHex != "" {
+			send, err := decodeHex(hc.SendHex)
+			if err != nil {
+				return errors.New(fmt.Sprintf("incorrect send_hex: %s", err))
+			}
+			hc.send = send
+		}
+		if hc.Expect != "" {
+			expect, err := regexp.Compile(hc.Expect)
+			if err != nil {
+				return err
+			}
+			hc.expect = expect
+		}
+		if hc.ExpectHex != "" {
+			expect, err := decodeHex(hc.ExpectHex)
+			if err != nil {
+				return errors.New(fmt.Sprintf("incorrect expect_hex: %s", err))
+			}
+			hc.expectBytes = expect
+		}
+	case "http":
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return errors.New("path must start with /")
+		}
+		for _, r := range hc.Status {
+			if r.Min < 100 || r.Max > 599 || r.Min > r.Max {
+				return errors.New(fmt.Sprintf("incorrect status range %d-%d", r.Min, r.Max))
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown type %s", hc.Type))
+	}
+
+	return nil
+}
+
+// decodeHex decodes a hex payload, spaces between the bytes are allowed
+func decodeHex(str string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(str), ""))
+}
+
+// expects reports whether the check reads a response after connecting
+func (hc *HealthCheck) expects() bool {
+	return hc.expect != nil || hc.expectBytes != nil
+}
+
+// matches reports whether the response read so far is the expected one
+func (hc *HealthCheck) matches(resp []byte) bool {
+	if hc.expectBytes != nil {
+		return bytes.HasPrefix(resp, hc.expectBytes)
+	}
+	return hc.expect.Match(resp)
+}
+
+// expected describes the expected response in errors
+func (hc *HealthCheck) expected() string {
+	if hc.expectBytes != nil {
+		return hex.EncodeToString(hc.expectBytes)
+	}
+	return hc.Expect
+}
+
+func (hc *HealthCheck) acceptsStatus(code int) bool {
+	if len(hc.Status) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, r := range hc.Status {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthChecker dials backends and takes the ones that stop answering out of
+// rotation until they answer again
+type HealthChecker struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+}
+
+func NewHealthChecker(cfg HealthCheckConfig) *HealthChecker {
+	h := &HealthChecker{
+		Interval: defaultCheckInterval * time.Millisecond,
+		Timeout:  defaultCheckTimeout * time.Millisecond,
+		Rise:     defaultCheckRise,
+		Fall:     defaultCheckFall,
+	}
+
+	if cfg.Interval > 0 {
+		h.Interval = time.Duration(cfg.Interval) * time.Millisecond
+	}
+	if cfg.Timeout > 0 {
+		h.Timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	if cfg.Rise > 0 {
+		h.Rise = cfg.Rise
+	}
+	if cfg.Fall > 0 {
+		h.Fall = cfg.Fall
+	}
+
+	return h
+}
+
+// CheckAll probes the backends concurrently and waits for every result
+func (h *HealthChecker) CheckAll(backends []Backend) {
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(backend Backend) {
+			defer wg.Done()
+			start := time.Now()
+			err := h.probe(backend)
+			h.record(backend, err, time.Since(start))
+		}(backend)
+	}
+	wg.Wait()
+}
+
+func (h *HealthChecker) probe(backend Backend) error {
+	if backend.HealthCheck != nil && backend.HealthCheck.Type == "http" {
+		return h.probeHTTP(backend.Url, backend.HealthCheck, backend.ProxyProtocol)
+	}
+
+	conn, err := h.dial(context.Background(), backend.Url, backend.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if backend.HealthCheck != nil && backend.HealthCheck.expects() {
+		return h.expect(conn, backend.HealthCheck)
+	}
+	return nil
+}
+
+// dial connects to a backend, announcing the check to backends that expect
+// a PROXY protocol header
+func (h *HealthChecker) dial(ctx context.Context, addr, proxyProtocol string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: h.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(h.Timeout))
+	if err := writeLocalProxyHeader(conn, proxyProtocol); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// expect sends the payload of the check and reads the response until it
+// matches the expected pattern, the backend closes or the timeout is hit
+func (h *HealthChecker) expect(conn net.Conn, hc *HealthCheck) error {
+	conn.SetDeadline(time.Now().Add(h.Timeout))
+
+	if len(hc.send) > 0 {
+		if _, err := conn.Write(hc.send); err != nil {
+			return err
+		}
+	}
+
+	var resp []byte
+	buf := make([]byte, 4096)
+	for len(resp) < maxCheckBody {
+		n, err := conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if hc.matches(resp) {
+			return nil
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Response %q does not match %q: %s", truncate(resp, 64), hc.expected(), err))
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Response %q does not match %q", truncate(resp, 64), hc.expected()))
+}
+
+func truncate(data []byte, n int) []byte {
+	if len(data) > n {
+		return data[:n]
+	}
+	return data
+}
+
+// probeHTTP sends the configured request and checks the status and body of
+// the response, so a backend counts as healthy only when the app answers
+func (h *HealthChecker) probeHTTP(addr string, hc *HealthCheck, proxyProtocol string) error {
+	method := hc.Method
+	if method == "" {
+		method = "GET"
+	}
+	path := hc.Path
+	if path == "" {
+		path = "/"
+	}
+
+	req, err := http.NewRequest(method, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	req.Header.Set("User-Agent", "mimi-proxy health check")
+
+	client := &http.Client{
+		Timeout: h.Timeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, target string) (net.Conn, error) {
+				return h.dial(ctx, target, proxyProtocol)
+			},
+		},
+		// the redirect itself is the answer
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !hc.acceptsStatus(resp.StatusCode) {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxCheckBody))
+		return errors.New(fmt.Sprintf("Unexpected status %d", resp.StatusCode))
+	}
+
+	if hc.Body != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(body, []byte(hc.Body)) {
+			return errors.New(fmt.Sprintf("Response body does not contain %q", hc.Body))
+		}
+	}
+
+	return nil
+}
+
+// record counts the probe result and flips the backend state once the rise
+// or fall threshold is reached
+func (h *HealthChecker) record(backend Backend, err error, latency time.Duration) {
+	stats := backend.stats
+	if stats == nil {
+		return
+	}
+
+	now := time.Now()
+	result := CheckResult{Time: now, Latency: float64(latency) / float64(time.Millisecond)}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	stats.history.add(result)
+
+	if err == nil {
+		stats.checkFailures = 0
+		stats.checkSuccesses++
+		if !backend.Healthy() && stats.checkSuccesses >= h.Rise {
+			log.Printf("Backend %s is up", backend.Id)
+			backend.setHealthy(true)
+			backend.startSlowStart()
+			stats.history.transition(now)
+		}
+		return
+	}
+
+	stats.checkSuccesses = 0
+	stats.checkFailures++
+	if backend.Healthy() && stats.checkFailures >= h.Fall {
+		log.Printf("Backend %s is down: %s", backend.Id, err)
+		backend.setHealthy(false)
+		stats.history.transition(now)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHealthCheckerRiseFall(t *testing.T) {
+	h := NewHealthChecker(HealthCheckConfig{Timeout: 100, Rise: 2, Fall: 2})
+
+	live, l := liveBackend(t, "live")
+	defer l.Close()
+	dead := deadBackend(t, "dead")
+
+	h.CheckAll([]Backend{live, dead})
+	if !live.Healthy() || !dead.Healthy() {
+		t.Fatalf("A single failure must not take a backend down")
+	}
+
+	h.CheckAll([]Backend{live, dead})
+	if !live.Healthy() {
+		t.Fatalf("Live backend marked down")
+	}
+	if dead.Healthy() || dead.Available() {
+		t.Fatalf("Dead backend still in rotation")
+	}
+
+	// the port starts answering again
+	revived, l2 := liveBackend(t, "dead")
+	defer l2.Close()
+	dead.Url = revived.Url
+
+	h.CheckAll([]Backend{dead})
+	if dead.Healthy() {
+		t.Fatalf("Backend came back before the rise threshold")
+	}
+	h.CheckAll([]Backend{dead})
+	if !dead.Healthy() {
+		t.Fatalf("Backend did not come back")
+	}
+}
+
+func TestStrategiesSkipUnhealthy(t *testing.T) {
+	for name := range strategyFactories {
+		s, _ := NewStrategy(name, nil)
+		b1, b2 := NewBackend("b1"), NewBackend("b2")
+		s.SetBackends([]Backend{b1, b2})
+		b2.setHealthy(false)
+
+		for i := 0; i < 10; i++ {
+			backend, err := s.NextBackend(&Selection{ClientAddr: "10.0.0.1:80"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backend.Id != "b1" {
+				t.Fatalf("%s: picked unhealthy backend", name)
+			}
+		}
+	}
+}
+
+func TestHealthCheckJson(t *testing.T) {
+	backend, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"type": "http", "path": "/ping", "status": [204, "200-299"]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := backend.HealthCheck
+	if hc == nil || hc.Path != "/ping" || len(hc.Status) != 2 || hc.Status[1].Max != 299 {
+		t.Fatalf("Unexpected health check: %+v", hc)
+	}
+
+	data, _ := json.Marshal(hc.Status)
+	if string(data) != `[204,"200-299"]` {
+		t.Fatalf("Unexpected status json: %s", data)
+	}
+
+	if _, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"type": "udp"}}`); err == nil {
+		t.Fatalf("Expected error on unknown check type")
+	}
+	if _, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"type": "http", "status": ["abc"]}}`); err == nil {
+		t.Fatalf("Expected error on incorrect status")
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	ready := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.Host != "app.example.com" {
+			w.WriteHeader(404)
+			return
+		}
+		if !ready {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprint(w, "database: ok")
+	}))
+	defer srv.Close()
+
+	h := NewHealthChecker(HealthCheckConfig{Timeout: 1000})
+	hc := &HealthCheck{Type: "http", Path: "/health", Host: "app.example.com", Body: "database: ok"}
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	if err := h.probeHTTP(addr, hc, ""); err == nil {
+		t.Fatalf("Expected failure while the app boots")
+	}
+
+	ready = true
+	if err := h.probeHTTP(addr, hc, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	hc.Body = "database: down"
+	if err := h.probeHTTP(addr, hc, ""); err == nil {
+		t.Fatalf("Expected failure on body mismatch")
+	}
+
+	hc.Body = ""
+	hc.Status = []StatusRange{{204, 204}}
+	if err := h.probeHTTP(addr, hc, ""); err == nil {
+		t.Fatalf("Expected failure on unexpected status")
+	}
+}
+
+// serveLines answers every line read from a connection with reply
+func serveLines(t *testing.T, banner string, reply func(line string) string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprint(conn, banner)
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fmt.Fprint(conn, reply(strings.TrimSpace(line)))
+				}
+			}(conn)
+		}
+	}()
+
+	return l
+}
+
+func TestHealthCheckSendExpect(t *testing.T) {
+	l := serveLines(t, "", func(line string) string {
+		if line == "PING" {
+			return "+PONG\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	defer l.Close()
+
+	h := NewHealthChecker(HealthCheckConfig{Timeout: 500})
+
+	backend, err := NewBackendFromJson("redis", fmt.Sprintf(`{"url": "%s", "health_check": {"send": "PING\r\n", "expect": "^\\+PONG"}}`, l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.probe(backend); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.HealthCheck = &HealthCheck{Send: "INFO\r\n", Expect: "^\\+PONG"}
+	backend.HealthCheck.validate()
+	if err := h.probe(backend); err == nil {
+		t.Fatalf("Expected failure on unexpected answer")
+	}
+
+	smtp := serveLines(t, "220 mail.example.com ESMTP\r\n", func(line string) string { return "" })
+	defer smtp.Close()
+	backend.Url = smtp.Addr().String()
+	backend.HealthCheck = &HealthCheck{Expect: "^220 "}
+	backend.HealthCheck.validate()
+	if err := h.probe(backend); err != nil {
+		t.Fatal(err)
+	}
+
+	// binary protocol, bytes past 0x7f go out and are matched unchanged
+	binary := serveLines(t, "", func(line string) string {
+		if line == "\x00\xff\x80" {
+			return "\x81\x00ok"
+		}
+		return "\x7f"
+	})
+	defer binary.Close()
+	backend, err = NewBackendFromJson("binary", fmt.Sprintf(`{"url": "%s", "health_check": {"send_hex": "00 ff 80 0a", "expect_hex": "8100"}}`, binary.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.probe(backend); err != nil {
+		t.Fatal(err)
+	}
+	backend.HealthCheck = &HealthCheck{SendHex: "00ff7f0a", ExpectHex: "8100"}
+	backend.HealthCheck.validate()
+	if err := h.probe(backend); err == nil {
+		t.Fatalf("Expected failure on unexpected binary answer")
+	}
+
+	if _, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"send": "PING"}}`); err == nil {
+		t.Fatalf("Expected error on send without expect")
+	}
+	if _, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"send": "PING", "send_hex": "00", "expect": "."}}`); err == nil {
+		t.Fatalf("Expected error on both send and send_hex")
+	}
+	if _, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"send_hex": "0g", "expect_hex": "00"}}`); err == nil {
+		t.Fatalf("Expected error on incorrect hex")
+	}
+	if _, err := NewBackendFromJson("b1", `{"url": "127.0.0.1:80", "health_check": {"expect": "("}}`); err == nil {
+		t.Fatalf("Expected error on incorrect pattern")
+	}
+}
+
+// proxyRequired accepts only connections opening with a PROXY protocol
+// header that announces no client, like the one of a health check
+type proxyRequired struct {
+	net.Listener
+}
+
+type headerConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c headerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (l proxyRequired) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		r := bufio.NewReader(c)
+		var src net.Addr
+		first, err := r.Peek(1)
+		switch {
+		case err != nil:
+		case first[0] == 'P':
+			src, _, err = readProxyHeaderV1(r)
+		case first[0] == proxyV2Signature[0]:
+			src, _, err = readProxyHeaderV2(r)
+		default:
+			err = errors.New("No proxy protocol header")
+		}
+		if err != nil || src != nil {
+			c.Close()
+			continue
+		}
+		return headerConn{c, r}, nil
+	}
+}
+
+func TestHealthCheckProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(proxyRequired{l}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+
+	h := NewHealthChecker(HealthCheckConfig{Timeout: 500})
+	backend := NewBackend("b1")
+	backend.Url = l.Addr().String()
+	backend.HealthCheck = &HealthCheck{Type: "http", Body: "ok"}
+
+	for _, version := range []string{proxyProtocolV1, proxyProtocolV2} {
+		backend.ProxyProtocol = version
+		if err := h.probe(backend); err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+	}
+	backend.ProxyProtocol = ""
+	if err := h.probe(backend); err == nil {
+		t.Fatalf("Expected failure without a proxy protocol header")
+	}
+
+	lines, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lines.Close()
+	go func() {
+		for {
+			c, err := proxyRequired{lines}.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				if line, _ := bufio.NewReader(c).ReadString('\n'); line == "PING\r\n" {
+					fmt.Fprint(c, "+PONG\r\n")
+				}
+			}(c)
+		}
+	}()
+
+	backend.Url = lines.Addr().String()
+	backend.HealthCheck = &HealthCheck{Send: "PING\r\n", Expect: "^\\+PONG"}
+	backend.HealthCheck.validate()
+	for _, version := range []string{proxyProtocolV1, proxyProtocolV2} {
+		backend.ProxyProtocol = version
+		if err := h.probe(backend); err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+	}
+}
+
+func TestAggregateStatus(t *testing.T) {
+	up, _ := json.Marshal(BackendStatus{Healthy: true, Available: true})
+	down, _ := json.Marshal(BackendStatus{Healthy: false})
+
+	status := &etcd.Node{Key: "/apps/u1/status", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/apps/u1/status/proxy1", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/apps/u1/status/proxy1/b1", Value: string(up)},
+			{Key: "/apps/u1/status/proxy1/b2", Value: string(up)},
+		}},
+		{Key: "/apps/u1/status/proxy2", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/apps/u1/status/proxy2/b1", Value: string(down)},
+			{Key: "/apps/u1/status/proxy2/b2", Value: string(up)},
+		}},
+	}}
+
+	backends := aggregateStatus(status)
+	if b1 := backends["b1"]; b1 == nil || b1.Available != 1 || b1.Unavailable != 1 || b1.Nodes["proxy2"].Healthy {
+		t.Fatalf("Expected b1 routed by proxy1 only, got %+v", b1)
+	}
+	if b2 := backends["b2"]; b2 == nil || b2.Available != 2 || b2.Unavailable != 0 {
+		t.Fatalf("Expected b2 routed by both nodes, got %+v", b2)
+	}
+
+	if !isStatus(&etcd.Response{Node: &etcd.Node{Key: "/apps/u1/status/proxy1/b1"}}) ||
+		isStatus(&etcd.Response{Node: &etcd.Node{Key: "/apps/u1/backends/status"}}) {
+		t.Fatalf("Status keys not told apart from configuration")
+	}
+}
+
+func TestHealthHistory(t *testing.T) {
+	h := NewHealthChecker(HealthCheckConfig{Timeout: 100, Rise: 1, Fall: 1})
+	dead := deadBackend(t, "dead")
+
+	if report := dead.Health(healthHistorySize); report.LastTransition != nil || len(report.Checks) != 0 {
+		t.Fatalf("Unexpected history of a new backend: %+v", report)
+	}
+
+	for i := 0; i < healthHistorySize+5; i++ {
+		h.CheckAll([]Backend{dead})
+	}
+	revived, l := liveBackend(t, "dead")
+	defer l.Close()
+	dead.Url = revived.Url
+	h.CheckAll([]Backend{dead})
+
+	report := dead.Health(healthHistorySize)
+	if len(report.Checks) != healthHistorySize {
+		t.Fatalf("Expected %d checks, got %d", healthHistorySize, len(report.Checks))
+	}
+	if report.Checks[0].Error != "" || report.Checks[1].Error == "" {
+		t.Fatalf("Checks not newest first: %+v", report.Checks[:2])
+	}
+	if report.Transitions != 2 || report.LastTransition == nil || !report.Healthy {
+		t.Fatalf("Expected 2 transitions ending up, got %+v", report)
+	}
+	if len(dead.Health(1).Checks) != 1 {
+		t.Fatalf("Expected a single check")
+	}
+}
+
+// run with -race, the status publisher reads while the watcher writes
+func TestApplicationBackendsConcurrentAccess(t *testing.T) {
+	c := NewCollection()
+	app := NewApplication("u1")
+	app.Frontends["f1"] = newTestFrontend(t)
+	c.AddApplication(app)
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, backends := range c.ApplicationBackends() {
+				for _, backend := range backends {
+					newBackendStatus(backend)
+				}
+			}
+			// the API encodes the applications meanwhile
+			c.AppGroups(app)
+			if _, err := c.MarshalApplications(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("b%d", i%5)
+		c.AddAppBackend(app, NewBackend(id))
+		if i%3 == 0 {
+			c.DeleteAppBackend(app, id)
+		}
+		frontend := newTestFrontend(t)
+		frontend.Id = fmt.Sprintf("f%d", i%4+2)
+		c.AddAppFrontend(app, frontend)
+		if i%4 == 0 {
+			c.DeleteAppFrontend(app, frontend.Id)
+		}
+		// the watcher applies the group weights saved by the API
+		if err := c.SetAppGroups(app, map[string]int{"default": 100 - i%50, "canary": i % 50}); err != nil {
+			t.Fatal(err)
+		}
+		c.AddApplication(NewApplication(fmt.Sprintf("u%d", i%3+2)))
+	}
+	close(stop)
+	wg.Wait()
+
+	if n := len(c.ApplicationBackends()); n != 4 {
+		t.Fatalf("Expected 4 applications, got %d", n)
+	}
+}
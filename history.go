@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// health check results kept per backend
+	healthHistorySize = 20
+	// how far back transitions are counted
+	transitionWindow = time.Hour
+)
+
+type CheckResult struct {
+	Time    time.Time `json:"time"`
+	Latency float64   `json:"latency"` // milliseconds
+	Error   string    `json:"error,omitempty"`
+}
+
+// healthHistory keeps the latest check results and the health transitions of
+// a backend, so flapping shows up in the API
+type healthHistory struct {
+	mu sync.Mutex
+	// ring of results, next is the slot of the following one
+	checks [healthHistorySize]CheckResult
+	next   int
+	count  int
+	// up and down flips within the transition window, oldest first
+	transitions []time.Time
+	lastFlip    time.Time
+}
+
+func (h *healthHistory) add(result CheckResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[h.next] = result
+	h.next = (h.next + 1) % healthHistorySize
+	if h.count < healthHistorySize {
+		h.count++
+	}
+}
+
+func (h *healthHistory) transition(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastFlip = at
+	h.transitions = append(h.prune(at), at)
+}
+
+// prune drops the transitions that fell out of the window
+func (h *healthHistory) prune(now time.Time) []time.Time {
+	i := 0
+	for i < len(h.transitions) && now.Sub(h.transitions[i]) > transitionWindow {
+		i++
+	}
+	h.transitions = h.transitions[i:]
+	return h.transitions
+}
+
+// BackendHealth is the health report of a backend returned by the API
+type BackendHealth struct {
+	BackendStatus
+	LastTransition *time.Time `json:"last_transition"`
+	// up and down flips in the last hour
+	Transitions int `json:"transitions"`
+	// latest check results, newest first
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+// Health returns the current status of the backend with up to checks of
+// its latest health check results
+func (b Backend) Health(checks int) BackendHealth {
+	report := BackendHealth{BackendStatus: newBackendStatus(b)}
+	if b.stats == nil {
+		return report
+	}
+
+	h := &b.stats.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.lastFlip.IsZero() {
+		last := h.lastFlip
+		report.LastTransition = &last
+	}
+	report.Transitions = len(h.prune(time.Now()))
+
+	if checks > h.count {
+		checks = h.count
+	}
+	for i := 1; i <= checks; i++ {
+		report.Checks = append(report.Checks, h.checks[(h.next-i+healthHistorySize)%healthHistorySize])
+	}
+
+	return report
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+const (
+	// connections are joined to the backend byte by byte
+	modeTCP = "tcp"
+	// requests are parsed and balanced one by one over pooled connections
+	modeHTTP = "http"
+)
+
+const (
+	maxIdleConnsPerBackend = 32
+	idleConnTimeout        = 90 * time.Second
+	clientIdleTimeout      = 120 * time.Second
+)
+
+var errListenerClosed = errors.New("Listener closed")
+
+// connListener hands the connections accepted by a frontend to an
+// http.Server
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push passes c to the server, or closes it if the listener is closed
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// dialTarget is passed to the dialer of the transport with the request
+type dialTarget struct {
+	backend  Backend
+	deadline time.Time
+	// connection of the client, announced to PROXY protocol backends
+	client net.Conn
+}
+
+type dialTargetKey struct{}
+
+// clientConnKey keeps the client connection in the context of its requests
+type clientConnKey struct{}
+
+// httpProxy balances the requests of a frontend in http mode. Every request
+// is sent to the backend picked for it over a pool of keep-alive
+// connections, so long lived clients are spread like new ones.
+type httpProxy struct {
+	frontend  *Frontend
+	listener  *connListener
+	transport *http.Transport
+	// for PROXY protocol backends, whose connections announce a single
+	// client and can't be shared
+	unpooled *http.Transport
+	server   *http.Server
+}
+
+func newHTTPProxy(f *Frontend) *httpProxy {
+	p := &httpProxy{
+		frontend: f,
+		listener: newConnListener(),
+	}
+	p.transport = &http.Transport{
+		DialContext:         p.dial,
+		MaxIdleConnsPerHost: maxIdleConnsPerBackend,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+	p.unpooled = &http.Transport{
+		DialContext:       p.dial,
+		DisableKeepAlives: true,
+	}
+	p.server = &http.Server{
+		Handler: &httputil.ReverseProxy{
+			Rewrite:        p.rewrite,
+			Transport:      p,
+			ModifyResponse: p.modifyResponse,
+			ErrorHandler:   p.handleError,
+		},
+		IdleTimeout: clientIdleTimeout,
+		ErrorLog:    f.server.Logger,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, clientConnKey{}, c)
+		},
+	}
+	return p
+}
+
+// rewrite prepares the request for the backend, the host is set once the
+// backend is picked
+func (p *httpProxy) rewrite(pr *httputil.ProxyRequest) {
+	pr.Out.URL.Scheme = "http"
+
+	f := p.frontend
+	f.lock.RLock()
+	forward := f.ForwardedHeaders
+	f.lock.RUnlock()
+
+	if forward {
+		f.forwardHeaders(pr.In, pr.Out)
+		return
+	}
+
+	// pass the headers of the client through untouched
+	for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+		if values, ok := pr.In.Header[name]; ok {
+			pr.Out.Header[name] = values
+		}
+	}
+}
+
+func (p *httpProxy) Serve() {
+	p.server.Serve(p.listener)
+}
+
+func (p *httpProxy) Close() {
+	p.server.Close()
+	p.transport.CloseIdleConnections()
+	p.unpooled.CloseIdleConnections()
+}
+
+// RoundTrip sends the request to a backend picked by the strategy. Requests
+// are retried on other backends only when the dial fails, so nothing has
+// reached the backend yet.
+func (p *httpProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := p.frontend
+	f.lock.RLock()
+	attempts, budget := f.DialAttempts, f.DialBudget
+	f.lock.RUnlock()
+
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var deadline time.Time
+	if budget > 0 {
+		deadline = time.Now().Add(time.Duration(budget) * time.Millisecond)
+	}
+
+	// the transport closes the body of a failed request, keep it for the
+	// next attempt, the server closes it when the handler is done
+	if req.Body != nil {
+		req.Body = ioutil.NopCloser(req.Body)
+	}
+
+	sel := &Selection{ClientAddr: req.RemoteAddr, Path: req.URL.Path}
+	f.lock.RLock()
+	sel.Group = canaryGroup(f.Canary, req)
+	sticky, stuck := f.stickyBackend(req, f.Sticky, sel)
+	f.lock.RUnlock()
+
+	client, _ := req.Context().Value(clientConnKey{}).(net.Conn)
+	var lastErr error
+	for attempts > 0 {
+		var backend Backend
+		var err error
+		if stuck {
+			// the first attempt goes to the backend of the session
+			backend, stuck = sticky, false
+		} else {
+			backend, err = f.nextBackend(sel)
+		}
+		if err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			break
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			if lastErr == nil {
+				lastErr = errDialBudget
+			}
+			break
+		}
+
+		allowed, trial := f.server.Breaker.Acquire(backend)
+		if !allowed {
+			sel.tried = append(sel.tried, backend.Id)
+			if lastErr == nil {
+				lastErr = errCircuitOpen
+			}
+			continue
+		}
+		attempts--
+
+		ctx := context.WithValue(req.Context(), dialTargetKey{}, dialTarget{backend, deadline, client})
+		out := req.Clone(ctx)
+		out.URL.Host = backend.Url
+
+		transport := p.transport
+		if backend.ProxyProtocol != "" {
+			transport = p.unpooled
+		}
+
+		backend.connOpened()
+		resp, err := transport.RoundTrip(out)
+		if err == nil {
+			f.server.Breaker.Record(backend, trial, resp.StatusCode < 500)
+			resp.Body = newBackendBody(resp.Body, backend)
+			return resp, nil
+		}
+		backend.connClosed()
+		f.server.Breaker.Record(backend, trial, false)
+
+		if !isDialError(err) {
+			return nil, err
+		}
+		sel.tried = append(sel.tried, backend.Id)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// dial opens a new pooled connection to the backend of the request
+func (p *httpProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	f := p.frontend
+	target, _ := ctx.Value(dialTargetKey{}).(dialTarget)
+	backend := target.backend
+
+	timeout := time.Duration(backend.ConnectTimeout) * time.Millisecond
+	if !target.deadline.IsZero() {
+		if left := target.deadline.Sub(time.Now()); left < timeout {
+			timeout = left
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	dialStart := time.Now()
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		f.server.Outliers.DialFailed(backend, f.currentStrategy().Backends())
+		f.server.Printf("Failed to dial backend connection %v: %v", addr, err)
+		return nil, err
+	}
+	backend.dialSucceeded(time.Since(dialStart))
+
+	if backend.ProxyProtocol != "" && target.client != nil {
+		err := writeProxyHeader(conn, backend.ProxyProtocol, target.client.RemoteAddr(), target.client.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// modifyResponse sets the sticky cookie naming the backend of the response
+func (p *httpProxy) modifyResponse(resp *http.Response) error {
+	f := p.frontend
+	f.lock.RLock()
+	sticky := f.Sticky
+	f.lock.RUnlock()
+
+	if sticky == nil {
+		return nil
+	}
+	if target, ok := resp.Request.Context().Value(dialTargetKey{}).(dialTarget); ok {
+		f.setStickyCookie(resp, sticky, target.backend)
+	}
+	return nil
+}
+
+func (p *httpProxy) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	server := p.frontend.server
+	server.Printf("Failed to proxy %s %s: %v", req.Method, req.URL, err)
+
+	status, page := http.StatusBadGateway, server.ErrorPage502
+	if err == errNoBackends || err == errCircuitOpen {
+		status, page = http.StatusServiceUnavailable, server.ErrorPage503
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, page)
+}
+
+// backendBody counts the request as an open connection of the backend until
+// the response is read
+type backendBody struct {
+	io.ReadCloser
+	backend Backend
+	once    sync.Once
+}
+
+func (b *backendBody) Close() error {
+	b.once.Do(b.backend.connClosed)
+	return b.ReadCloser.Close()
+}
+
+// upgradedBody is the body of a switched protocol response, the proxy
+// writes to it too
+type upgradedBody struct {
+	*backendBody
+}
+
+func (b upgradedBody) Write(data []byte) (int, error) {
+	return b.ReadCloser.(io.Writer).Write(data)
+}
+
+func newBackendBody(body io.ReadCloser, backend Backend) io.ReadCloser {
+	b := &backendBody{ReadCloser: body, backend: backend}
+	if _, ok := body.(io.ReadWriteCloser); ok {
+		return upgradedBody{b}
+	}
+	return b
+}
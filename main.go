@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/mimicloud/easyconfig"
 	"io/ioutil"
+	"log"
 	"os"
 )
 
@@ -24,6 +26,15 @@ var config = struct {
 	EtcdServers      []string             `json:"etcd_servers"`
 	ErrorPage502     string               `json:"502_error_page"`
 	ErrorPage503     string               `json:"503_error_page"`
+	HealthCheck      HealthCheckConfig    `json:"health_check"`
+	OutlierDetection OutlierConfig        `json:"outlier_detection"`
+	CircuitBreaker   BreakerConfig        `json:"circuit_breaker"`
+	// load balancers whose PROXY protocol headers are accepted
+	AcceptProxyProtocol []string `json:"accept_proxy_protocol"`
+	// signs sticky session cookies, random if empty
+	StickySecret string `json:"sticky_secret"`
+	// name backend health is published under, the hostname by default
+	NodeName string `json:"node_name"`
 }{}
 
 var etcdClient *etcd.Client
@@ -65,8 +76,34 @@ func main() {
 
 	secureFrontends, insecureFrontends := ResolveApps(etcdClient, config.EtcdKey)
 
+	outliers := NewOutlierDetector(config.OutlierDetection)
+	breaker := NewCircuitBreaker(config.CircuitBreaker)
+	proxyProtocolFrom, err := parseTrustedProxies(config.AcceptProxyProtocol)
+	if err != nil {
+		panic(err)
+	}
+	stickySecret := []byte(config.StickySecret)
+	if len(stickySecret) == 0 {
+		// cookies of one node would be rejected by the others
+		for _, frontends := range []map[string]*Frontend{secureFrontends, insecureFrontends} {
+			for id, frontend := range frontends {
+				if frontend.Sticky != nil {
+					log.Fatalf("Frontend %s uses sticky sessions, set sticky_secret in the config", id)
+				}
+			}
+		}
+		stickySecret = make([]byte, 32)
+		if _, err := rand.Read(stickySecret); err != nil {
+			panic(err)
+		}
+	}
+
 	secureServer := NewServer(config.SecureBindAddr, true, string(errorPage502), string(errorPage503))
 	secureServer.Frontends = secureFrontends
+	secureServer.Outliers = outliers
+	secureServer.Breaker = breaker
+	secureServer.ProxyProtocolFrom = proxyProtocolFrom
+	secureServer.StickySecret = stickySecret
 
 	// Start secure (:443 port) server
 	go func() {
@@ -79,6 +116,10 @@ func main() {
 
 	insecureServer := NewServer(config.InsecureBindAddr, false, string(errorPage502), string(errorPage503))
 	insecureServer.Frontends = insecureFrontends
+	insecureServer.Outliers = outliers
+	insecureServer.Breaker = breaker
+	insecureServer.ProxyProtocolFrom = proxyProtocolFrom
+	insecureServer.StickySecret = stickySecret
 
 	// Start insecure (:80 port) server
 	go func() {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultOutlierFailures   = 5
+	defaultBaseEjection      = 30000  // milliseconds
+	defaultMaxEjection       = 300000 // milliseconds
+	defaultMaxEjectedPercent = 50
+)
+
+type OutlierConfig struct {
+	// dials failed in a row before a backend is ejected, -1 disables detection
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	BaseEjection        int `json:"base_ejection"` // milliseconds
+	MaxEjection         int `json:"max_ejection"`  // milliseconds
+	// share of the backends of an app that may be ejected at once
+	MaxEjectedPercent int `json:"max_ejected_percent"`
+}
+
+// OutlierDetector ejects backends that keep failing the dials of live
+// connections, between and long before active health checks notice. Every
+// ejection of a backend lasts twice as long as the previous one, up to
+// MaxEjection.
+type OutlierDetector struct {
+	ConsecutiveFailures int
+	BaseEjection        time.Duration
+	MaxEjection         time.Duration
+	MaxEjectedPercent   int
+
+	// serializes ejections, so backends failing together can't all pass the
+	// cap and the last backend rule at once
+	mu sync.Mutex
+}
+
+func NewOutlierDetector(cfg OutlierConfig) *OutlierDetector {
+	d := &OutlierDetector{
+		ConsecutiveFailures: defaultOutlierFailures,
+		BaseEjection:        defaultBaseEjection * time.Millisecond,
+		MaxEjection:         defaultMaxEjection * time.Millisecond,
+		MaxEjectedPercent:   defaultMaxEjectedPercent,
+	}
+
+	if cfg.ConsecutiveFailures != 0 {
+		d.ConsecutiveFailures = cfg.ConsecutiveFailures
+	}
+	if cfg.BaseEjection > 0 {
+		d.BaseEjection = time.Duration(cfg.BaseEjection) * time.Millisecond
+	}
+	if cfg.MaxEjection > 0 {
+		d.MaxEjection = time.Duration(cfg.MaxEjection) * time.Millisecond
+	}
+	if cfg.MaxEjectedPercent > 0 {
+		d.MaxEjectedPercent = cfg.MaxEjectedPercent
+	}
+
+	return d
+}
+
+// DialFailed records a failed dial of backend, one of the backends of pool
+func (d *OutlierDetector) DialFailed(backend Backend, pool []Backend) {
+	failures := backend.dialFailed()
+	if d == nil || d.ConsecutiveFailures <= 0 || failures < d.ConsecutiveFailures || backend.Ejected() {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if backend.Ejected() {
+		return
+	}
+
+	// the cap rounds down, and the last available backend is never ejected,
+	// a backend failing some dials still beats answering every client 503
+	ejected, others := 0, 0
+	for _, b := range pool {
+		if b.Ejected() {
+			ejected++
+		} else if b.Id != backend.Id && b.Available() {
+			others++
+		}
+	}
+	if max := len(pool) * d.MaxEjectedPercent / 100; ejected >= max {
+		log.Printf("Backend %s failed %d dials in a row, %d of %d backends are ejected already", backend.Id, failures, ejected, len(pool))
+		return
+	}
+	if others == 0 {
+		log.Printf("Backend %s failed %d dials in a row, but no other backend is available", backend.Id, failures)
+		return
+	}
+
+	d.eject(backend)
+}
+
+func (d *OutlierDetector) eject(backend Backend) {
+	stats := backend.stats
+	now := time.Now()
+
+	// forget old ejections of a backend that behaved for a long time
+	if last := atomic.LoadInt64(&stats.ejectedUntil); last != 0 && now.Sub(time.Unix(0, last)) > d.MaxEjection {
+		atomic.StoreInt32(&stats.ejections, 0)
+	}
+
+	n := atomic.AddInt32(&stats.ejections, 1)
+	duration := d.BaseEjection
+	for i := int32(1); i < n && duration < d.MaxEjection; i++ {
+		duration *= 2
+	}
+	if duration > d.MaxEjection {
+		duration = d.MaxEjection
+	}
+
+	atomic.StoreInt64(&stats.ejectedUntil, now.Add(duration).UnixNano())
+	atomic.StoreInt32(&stats.dialFailures, 0)
+	log.Printf("Backend %s ejected for %s", backend.Id, duration)
+}
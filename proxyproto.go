@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// signature opening every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func validProxyProtocol(version string) bool {
+	return version == "" || version == proxyProtocolV1 || version == proxyProtocolV2
+}
+
+// writeProxyHeader tells the backend on w that the connection comes from
+// src and was made to dst, in the given PROXY protocol version
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case "":
+		return nil
+	case proxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case proxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return errors.New(fmt.Sprintf("Unknown proxy protocol %s", version))
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// writeLocalProxyHeader tells the backend on w that the connection is made
+// by the proxy itself, for health checks, as v1 UNKNOWN or v2 LOCAL
+func writeLocalProxyHeader(w io.Writer, version string) error {
+	return writeProxyHeader(w, version, nil, nil)
+}
+
+// proxyAddrs returns the TCP addresses of a connection, both IPv4 or both
+// IPv6, and false if they aren't TCP addresses
+func proxyAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	srcTCP, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	dstTCP, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil {
+		return &net.TCPAddr{IP: srcTCP.IP.To4(), Port: srcTCP.Port},
+			&net.TCPAddr{IP: dstTCP.IP.To4(), Port: dstTCP.Port}, true
+	}
+	return &net.TCPAddr{IP: srcTCP.IP.To16(), Port: srcTCP.Port},
+		&net.TCPAddr{IP: dstTCP.IP.To16(), Port: dstTCP.Port}, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcTCP, dstTCP, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if len(srcTCP.IP) == net.IPv6len {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port))
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+
+	srcTCP, dstTCP, ok := proxyAddrs(src, dst)
+	if !ok {
+		// LOCAL command, the backend uses the real addresses of the connection
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// version 2, PROXY command, then TCP over IPv4 or IPv6
+	buf.WriteByte(0x21)
+	if len(srcTCP.IP) == net.IPv4len {
+		buf.WriteByte(0x11)
+	} else {
+		buf.WriteByte(0x21)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcTCP.IP)+4))
+	buf.Write(srcTCP.IP)
+	buf.Write(dstTCP.IP)
+	binary.Write(&buf, binary.BigEndian, uint16(srcTCP.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dstTCP.Port))
+
+	return buf.Bytes()
+}
+
+// how long a trusted peer may take to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// maximum length of a v1 header line
+const maxProxyHeaderV1 = 107
+
+// proxyListener accepts connections carrying a PROXY protocol header, so the
+// address of the client is known behind a TCP load balancer
+type proxyListener struct {
+	net.Listener
+	// peers allowed to send the header, anybody else is taken as the client
+	trusted []*net.IPNet
+}
+
+func newProxyListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, trusted: l.trusted}, nil
+}
+
+// proxyConn reads the PROXY header on the first use of the connection, so a
+// slow peer doesn't hold up the accept loop
+type proxyConn struct {
+	net.Conn
+	trusted []*net.IPNet
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+
+	// read deadline set by the user of the connection, restored after the
+	// header is read
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.local
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) readHeader() {
+	c.reader = bufio.NewReader(c.Conn)
+	c.remote = c.Conn.RemoteAddr()
+	c.local = c.Conn.LocalAddr()
+
+	host, _, _ := net.SplitHostPort(c.remote.String())
+	if !isTrusted(c.trusted, host) {
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer func() {
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	}()
+
+	// peek no further than the first byte tells, short messages of peers
+	// sending no header must not wait for more data
+	var src, dst net.Addr
+	first, err := c.reader.Peek(1)
+	switch {
+	case err != nil:
+	case first[0] == proxyV2Signature[0]:
+		if sig, err := c.reader.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+			src, dst, c.err = readProxyHeaderV2(c.reader)
+		}
+	case first[0] == 'P':
+		if prefix, err := c.reader.Peek(6); err == nil && string(prefix) == "PROXY " {
+			src, dst, c.err = readProxyHeaderV1(c.reader)
+		}
+	}
+	// no header, the peer itself is the client
+
+	if c.err != nil {
+		c.Conn.Close()
+		return
+	}
+	if src != nil {
+		c.remote, c.local = src, dst
+	}
+}
+
+// readProxyHeaderV1 returns the addresses of a v1 header, nil for UNKNOWN
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyHeaderV1 {
+			return nil, nil, errors.New("Proxy protocol header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New(fmt.Sprintf("Incorrect proxy protocol header %q", line))
+	}
+
+	src, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(fields[2], fields[4]))
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(fields[3], fields[5]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// readProxyHeaderV2 returns the addresses of a v2 header, nil for LOCAL
+// connections and families other than TCP
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	fixed := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, nil, errors.New(fmt.Sprintf("Unknown proxy protocol version %d", verCmd>>4))
+	}
+	if verCmd&0xf == 0 {
+		return nil, nil, nil
+	}
+
+	var size int
+	switch family {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("Proxy protocol header too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return src, dst, nil
+}
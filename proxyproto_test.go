@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// acceptProxied sends data through a proxy listener trusting the given
+// networks and returns the accepted connection
+func acceptProxied(t *testing.T, trusted []string, data []byte) net.Conn {
+	nets, err := parseTrustedProxies(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newProxyListener(tl, nets)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(data)
+	client.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	v2 := proxyHeaderV2(
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443})
+
+	cases := []struct {
+		trusted []string
+		data    []byte
+		remote  string
+	}{
+		{[]string{"127.0.0.1"}, []byte("PROXY TCP4 203.0.113.9 10.0.0.1 5555 443\r\nhello"), "203.0.113.9:5555"},
+		{[]string{"127.0.0.0/8"}, append(v2, "hello"...), "[2001:db8::1]:5000"},
+		{[]string{"127.0.0.1"}, []byte("PROXY UNKNOWN\r\nhello"), ""},
+		// a trusted peer may send no header
+		{[]string{"127.0.0.1"}, []byte("hello"), ""},
+	}
+
+	for _, tc := range cases {
+		c := acceptProxied(t, tc.trusted, tc.data)
+		data, err := ioutil.ReadAll(c)
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("Expected hello after the header, got %q %v", data, err)
+		}
+		remote := c.RemoteAddr().String()
+		if tc.remote != "" && remote != tc.remote {
+			t.Fatalf("Expected client %s, got %s", tc.remote, remote)
+		}
+		if tc.remote == "" && c.RemoteAddr().(*net.TCPAddr).IP.String() != "127.0.0.1" {
+			t.Fatalf("Expected the peer as client, got %s", remote)
+		}
+		c.Close()
+	}
+
+	// headers of untrusted peers are data
+	spoofed := "PROXY TCP4 203.0.113.9 10.0.0.1 5555 443\r\nhello"
+	c := acceptProxied(t, []string{"10.0.0.0/8"}, []byte(spoofed))
+	defer c.Close()
+	if data, _ := ioutil.ReadAll(c); string(data) != spoofed {
+		t.Fatalf("Header of untrusted peer was parsed: %q", data)
+	}
+
+	c = acceptProxied(t, []string{"127.0.0.1"}, []byte("PROXY TCP4 garbage\r\nhello"))
+	defer c.Close()
+	if _, err := ioutil.ReadAll(c); err == nil {
+		t.Fatalf("Expected error for incorrect header")
+	}
+}
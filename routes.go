@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Route sends the requests under a path prefix to the backends with one of
+// its tags
+type Route struct {
+	Path string   `json:"path"`
+	Tags []string `json:"tags"`
+	// balances the backends of the route, the strategy of the frontend if empty
+	Strategy       string          `json:"strategy,omitempty"`
+	StrategyParams json.RawMessage `json:"strategy_params,omitempty"`
+}
+
+func (r Route) validate() error {
+	if !strings.HasPrefix(r.Path, "/") {
+		return errors.New(fmt.Sprintf("Route path %q must start with /", r.Path))
+	}
+	if len(r.Tags) == 0 {
+		return errors.New(fmt.Sprintf("Route %s has no tags", r.Path))
+	}
+	return nil
+}
+
+// matches reports whether backend has one of the tags of the route
+func (r Route) matches(backend Backend) bool {
+	for _, tag := range r.Tags {
+		if backend.hasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameRoutes(a, b []Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Strategy != b[i].Strategy ||
+			string(a[i].StrategyParams) != string(b[i].StrategyParams) ||
+			strings.Join(a[i].Tags, ",") != strings.Join(b[i].Tags, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+type route struct {
+	Route
+	strategy BackendStrategy
+}
+
+// RouteStrategy picks backends by the path of the request. Each route
+// balances its tagged backends with its own strategy, requests matching no
+// route and TCP connections go to the backends matching no route.
+type RouteStrategy struct {
+	// longest path first, immutable
+	routes   []*route
+	fallback BackendStrategy
+}
+
+// NewRouteStrategy creates the strategies of a frontend, a RouteStrategy if
+// it has routes
+func NewRouteStrategy(name string, params json.RawMessage, routes []Route) (BackendStrategy, error) {
+	fallback, err := NewStrategy(name, params)
+	if err != nil || len(routes) == 0 {
+		return fallback, err
+	}
+
+	s := &RouteStrategy{fallback: fallback}
+	for _, r := range routes {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+
+		strategyName, strategyParams := r.Strategy, r.StrategyParams
+		if strategyName == "" {
+			strategyName, strategyParams = name, params
+		}
+		strategy, err := NewStrategy(strategyName, strategyParams)
+		if err != nil {
+			return nil, err
+		}
+		s.routes = append(s.routes, &route{r, strategy})
+	}
+
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		return len(s.routes[i].Path) > len(s.routes[j].Path)
+	})
+
+	return s, nil
+}
+
+// strategyFor returns the strategy of the route matching path
+func (s *RouteStrategy) strategyFor(path string) BackendStrategy {
+	for _, r := range s.routes {
+		if strings.HasPrefix(path, r.Path) {
+			return r.strategy
+		}
+	}
+	return s.fallback
+}
+
+func (s *RouteStrategy) NextBackend(sel *Selection) (Backend, error) {
+	path := ""
+	if sel != nil {
+		path = sel.Path
+	}
+	return s.strategyFor(path).NextBackend(sel)
+}
+
+// backendsFor returns the backends of the route matching the path of sel
+func (s *RouteStrategy) backendsFor(sel *Selection) []Backend {
+	path := ""
+	if sel != nil {
+		path = sel.Path
+	}
+	return selectableBackends(s.strategyFor(path), sel)
+}
+
+func (s *RouteStrategy) AddBackend(backend Backend) {
+	routed := false
+	for _, r := range s.routes {
+		if r.matches(backend) {
+			r.strategy.AddBackend(backend)
+			routed = true
+		}
+	}
+	if !routed {
+		s.fallback.AddBackend(backend)
+	}
+}
+
+func (s *RouteStrategy) DeleteBackend(id string) error {
+	err := s.fallback.DeleteBackend(id)
+	for _, r := range s.routes {
+		if r.strategy.DeleteBackend(id) == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (s *RouteStrategy) SetBackends(backends []Backend) {
+	sets := make([][]Backend, len(s.routes))
+	var rest []Backend
+	for _, backend := range backends {
+		routed := false
+		for i, r := range s.routes {
+			if r.matches(backend) {
+				sets[i] = append(sets[i], backend)
+				routed = true
+			}
+		}
+		if !routed {
+			rest = append(rest, backend)
+		}
+	}
+
+	for i, r := range s.routes {
+		r.strategy.SetBackends(sets[i])
+	}
+	s.fallback.SetBackends(rest)
+}
+
+// Backends returns every backend once, even if it serves several routes
+func (s *RouteStrategy) Backends() []Backend {
+	backends := s.fallback.Backends()
+	seen := make(map[string]bool)
+	for _, backend := range backends {
+		seen[backend.Id] = true
+	}
+	for _, r := range s.routes {
+		for _, backend := range r.strategy.Backends() {
+			if !seen[backend.Id] {
+				seen[backend.Id] = true
+				backends = append(backends, backend)
+			}
+		}
+	}
+	return backends
+}
@@ -33,6 +33,15 @@ type Server struct {
 	ErrorPage502 string
 	ErrorPage503 string
 	Frontends    map[string]*Frontend
+	// ejects backends failing the dials of live connections, nil to disable
+	Outliers *OutlierDetector
+	// trips the circuits of backends whose connections keep failing, nil to disable
+	Breaker *CircuitBreaker
+	// peers whose PROXY protocol headers give the client address, nil to
+	// disable
+	ProxyProtocolFrom []*net.IPNet
+	// signs the sticky session cookies, the same on every proxy node
+	StickySecret []byte
 
 	muxTLS  *vhost.TLSMuxer
 	muxHTTP *vhost.HTTPMuxer
@@ -48,6 +57,9 @@ func (s *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	if len(s.ProxyProtocolFrom) > 0 {
+		l = newProxyListener(l, s.ProxyProtocolFrom)
+	}
 
 	s.Printf("Serving connections on %v, frontends: %d", l.Addr(), len(s.Frontends))
 
@@ -87,6 +99,7 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) AddFrontend(frontend *Frontend) {
+	warnStickySecret(frontend)
 	if f, ok := s.Frontends[frontend.Id]; ok {
 		f.Stop()
 	}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/coreos/go-etcd/etcd"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// BackendStatus is the view of one proxy node on the health of a backend,
+// published to etcd under /<etcd_key>/<app>/status/<node>/<backend>
+type BackendStatus struct {
+	Healthy     bool      `json:"healthy"`
+	Available   bool      `json:"available"`
+	Draining    bool      `json:"draining"`
+	Ejected     bool      `json:"ejected"`
+	Circuit     string    `json:"circuit"`
+	Connections int64     `json:"connections"`
+	Updated     time.Time `json:"updated"`
+}
+
+func newBackendStatus(b Backend) BackendStatus {
+	return BackendStatus{
+		Healthy:     b.Healthy(),
+		Available:   b.Available(),
+		Draining:    b.Draining(),
+		Ejected:     b.Ejected(),
+		Circuit:     b.CircuitState(),
+		Connections: b.Connections(),
+		Updated:     time.Now(),
+	}
+}
+
+// StatusPublisher writes the backend health seen by this node to etcd. The
+// keys expire after a few check intervals, so a node that stops publishing
+// disappears from the aggregated view instead of reporting stale health.
+type StatusPublisher struct {
+	client  *etcd.Client
+	etcdKey string
+	Node    string
+	TTL     uint64 // seconds
+}
+
+func NewStatusPublisher(client *etcd.Client, etcdKey, node string, interval time.Duration) *StatusPublisher {
+	ttl := uint64(3 * interval / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	return &StatusPublisher{client: client, etcdKey: etcdKey, Node: node, TTL: ttl}
+}
+
+// nodeName returns the name this node publishes its status under
+func nodeName() string {
+	if config.NodeName != "" {
+		return config.NodeName
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "unknown"
+}
+
+func statusKey(etcdKey, appId string) string {
+	return "/" + etcdKey + "/" + appId + "/status"
+}
+
+// Publish writes the status of the backends of every app, by app id
+func (p *StatusPublisher) Publish(apps map[string][]Backend) {
+	for appId, backends := range apps {
+		for _, backend := range backends {
+			value, err := json.Marshal(newBackendStatus(backend))
+			if err != nil {
+				continue
+			}
+			key := statusKey(p.etcdKey, appId) + "/" + p.Node + "/" + backend.Id
+			if _, err := p.client.Set(key, string(value), p.TTL); err != nil {
+				log.Printf("Failed to publish status of backend %s: %s", backend.Id, err)
+			}
+		}
+	}
+}
+
+// BackendFleetStatus aggregates the views of all proxy nodes on a backend
+type BackendFleetStatus struct {
+	// nodes that route to the backend
+	Available int `json:"available"`
+	// nodes that don't
+	Unavailable int                      `json:"unavailable"`
+	Nodes       map[string]BackendStatus `json:"nodes"`
+}
+
+// aggregateStatus collects the views published under the status node of an
+// app by backend
+func aggregateStatus(status *etcd.Node) map[string]*BackendFleetStatus {
+	backends := make(map[string]*BackendFleetStatus)
+	if status == nil {
+		return backends
+	}
+
+	for _, nodeDir := range status.Nodes {
+		node := nodeDir.Key[strings.LastIndex(nodeDir.Key, "/")+1:]
+		for _, n := range nodeDir.Nodes {
+			var s BackendStatus
+			if err := json.Unmarshal([]byte(n.Value), &s); err != nil {
+				continue
+			}
+
+			id := n.Key[strings.LastIndex(n.Key, "/")+1:]
+			fleet, ok := backends[id]
+			if !ok {
+				fleet = &BackendFleetStatus{Nodes: make(map[string]BackendStatus)}
+				backends[id] = fleet
+			}
+			fleet.Nodes[node] = s
+			if s.Available {
+				fleet.Available++
+			} else {
+				fleet.Unavailable++
+			}
+		}
+	}
+
+	return backends
+}
+
+func isStatus(r *etcd.Response) bool {
+	parts := strings.Split(r.Node.Key, "/")
+	return len(parts) > 3 && parts[3] == "status"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const defaultStickyCookie = "mimi_backend"
+
+// StickyConfig keeps the clients of a frontend on one backend with a cookie
+type StickyConfig struct {
+	Cookie string `json:"cookie,omitempty"`
+	MaxAge int    `json:"max_age,omitempty"` // seconds, 0 for a session cookie
+}
+
+func (s *StickyConfig) cookieName() string {
+	if s.Cookie == "" {
+		return defaultStickyCookie
+	}
+	return s.Cookie
+}
+
+// warnStickySecret logs a frontend with sticky sessions added while running
+// without sticky_secret, each node then signs with a random secret of its own
+func warnStickySecret(frontend *Frontend) {
+	if frontend.Sticky != nil && config.StickySecret == "" {
+		log.Printf("WARNING: frontend %s uses sticky sessions without sticky_secret in the config, other proxy nodes reject its cookies", frontend.Id)
+	}
+}
+
+// signSticky returns the cookie value naming the backend, signed so clients
+// can't pick a backend themselves
+func (f *Frontend) signSticky(backendId string) string {
+	mac := hmac.New(sha256.New, f.server.StickySecret)
+	mac.Write([]byte(f.Id + "\x00" + backendId))
+	return backendId + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stickyBackend returns the backend named by the sticky cookie of the
+// request, if the signature matches and the backend is available and may
+// serve sel, so the route of the path and the canary group still apply
+func (f *Frontend) stickyBackend(req *http.Request, sticky *StickyConfig, sel *Selection) (Backend, bool) {
+	if sticky == nil {
+		return Backend{}, false
+	}
+	cookie, err := req.Cookie(sticky.cookieName())
+	if err != nil {
+		return Backend{}, false
+	}
+
+	i := strings.LastIndex(cookie.Value, ".")
+	if i < 0 {
+		return Backend{}, false
+	}
+	id := cookie.Value[:i]
+	if !hmac.Equal([]byte(cookie.Value), []byte(f.signSticky(id))) {
+		return Backend{}, false
+	}
+
+	for _, backend := range selectableBackends(f.currentStrategy(), sel) {
+		if backend.Id == id {
+			return backend, backend.Available()
+		}
+	}
+	return Backend{}, false
+}
+
+// setStickyCookie names the backend that served the response in a cookie,
+// unless the request already had it
+func (f *Frontend) setStickyCookie(resp *http.Response, sticky *StickyConfig, backend Backend) {
+	value := f.signSticky(backend.Id)
+	if cookie, err := resp.Request.Cookie(sticky.cookieName()); err == nil && cookie.Value == value {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     sticky.cookieName(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   sticky.MaxAge,
+		Secure:   resp.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
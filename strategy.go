@@ -1,54 +1,681 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type RoundRobinStrategy struct {
-	backends []Backend
-	idx      int
+// Strategies are read from every connection goroutine and changed by the
+// etcd watcher and the API. Picks never lock: each strategy publishes an
+// immutable snapshot of its backends through an atomic.Value and keeps its
+// rotation state in atomic counters. Writers serialize on a mutex and
+// publish a fresh snapshot instead of modifying the current one.
+
+var errNoBackends = errors.New("Backends not found. Skipping.")
+
+// backendList is a copy-on-write list of backends
+type backendList struct {
+	mu       sync.Mutex
+	backends atomic.Value // []Backend
 }
 
-func (s *RoundRobinStrategy) NextBackend() (Backend, error) {
-	n := len(s.backends)
+// load returns the current snapshot, it must not be modified
+func (l *backendList) load() []Backend {
+	backends, _ := l.backends.Load().([]Backend)
+	return backends
+}
 
-	if n == 0 {
-		return Backend{}, errors.New("Backends not found. Skipping.")
+// change publishes the list returned by fn. publish, if set, is called with
+// the new list while writers are still locked out, to build derived snapshots.
+func (l *backendList) change(fn func(old []Backend) ([]Backend, error), publish func([]Backend)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	backends, err := fn(l.load())
+	if err != nil {
+		return err
 	}
 
-	if n == 1 {
-		return s.backends[0], nil
-	} else {
-		s.idx = (s.idx + 1) % n
-		return s.backends[s.idx], nil
+	l.backends.Store(backends)
+	if publish != nil {
+		publish(backends)
+	}
+	return nil
+}
+
+func (l *backendList) add(backend Backend, publish func([]Backend)) {
+	l.change(func(old []Backend) ([]Backend, error) {
+		return append(old[:len(old):len(old)], backend), nil
+	}, publish)
+}
+
+func (l *backendList) set(backends []Backend, publish func([]Backend)) {
+	l.change(func(old []Backend) ([]Backend, error) {
+		return append([]Backend(nil), backends...), nil
+	}, publish)
+}
+
+func (l *backendList) remove(id string, publish func([]Backend)) error {
+	return l.change(func(old []Backend) ([]Backend, error) {
+		return deleteBackend(old, id)
+	}, publish)
+}
+
+func (l *backendList) copy() []Backend {
+	return append([]Backend(nil), l.load()...)
+}
+
+var randState = uint64(time.Now().UnixNano())
+
+// randUint64 is a lock-free splitmix64 generator for picks on the hot path
+func randUint64() uint64 {
+	z := atomic.AddUint64(&randState, 0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func randIntn(n int) int {
+	return int(randUint64() % uint64(n))
+}
+
+func randFloat64() float64 {
+	return float64(randUint64()>>11) / (1 << 53)
+}
+
+type RoundRobinStrategy struct {
+	idx  uint64
+	list backendList
+}
+
+func (s *RoundRobinStrategy) NextBackend(sel *Selection) (Backend, error) {
+	backends := s.list.load()
+	n := uint64(len(backends))
+
+	start := atomic.AddUint64(&s.idx, 1)
+	for i := uint64(0); i < n; i++ {
+		backend := backends[(start+i)%n]
+		if sel.accepts(backend) {
+			return backend, nil
+		}
 	}
+
+	return Backend{}, errNoBackends
 }
 
 func (s *RoundRobinStrategy) AddBackend(backend Backend) {
-	s.backends = append(s.backends, backend)
+	s.list.add(backend, nil)
+}
+
+func (s *RoundRobinStrategy) Backends() []Backend {
+	return s.list.copy()
 }
 
 func (s *RoundRobinStrategy) SetBackends(backends []Backend) {
-	s.backends = backends
+	s.list.set(backends, nil)
 }
 
 func (s *RoundRobinStrategy) DeleteBackend(id string) error {
-	log.Printf("Strategy: delete backend")
-	for i, backend := range s.backends {
+	return s.list.remove(id, nil)
+}
+
+// LeastConnectionsStrategy picks the backend with the fewest live connections.
+// Ties are broken in round-robin order.
+type LeastConnectionsStrategy struct {
+	idx  uint64
+	list backendList
+}
+
+func (s *LeastConnectionsStrategy) NextBackend(sel *Selection) (Backend, error) {
+	backends := s.list.load()
+	n := uint64(len(backends))
+
+	// start the scan after the previous pick so equal backends take turns
+	start := atomic.AddUint64(&s.idx, 1)
+	best, bestConns := -1, int64(0)
+	for i := uint64(0); i < n; i++ {
+		j := int((start + i) % n)
+		if !sel.accepts(backends[j]) {
+			continue
+		}
+		if conns := backends[j].Connections(); best < 0 || conns < bestConns {
+			best, bestConns = j, conns
+		}
+	}
+
+	if best < 0 {
+		return Backend{}, errNoBackends
+	}
+	return backends[best], nil
+}
+
+func (s *LeastConnectionsStrategy) AddBackend(backend Backend) {
+	s.list.add(backend, nil)
+}
+
+func (s *LeastConnectionsStrategy) Backends() []Backend {
+	return s.list.copy()
+}
+
+func (s *LeastConnectionsStrategy) SetBackends(backends []Backend) {
+	s.list.set(backends, nil)
+}
+
+func (s *LeastConnectionsStrategy) DeleteBackend(id string) error {
+	return s.list.remove(id, nil)
+}
+
+// longest schedule of the weighted round-robin, larger weights are scaled down
+const maxWeightSchedule = 1 << 16
+
+// WeightedRoundRobinStrategy spreads connections in proportion to backend
+// weights using the smooth weighted round-robin from nginx: every step adds
+// each backend's weight to its current weight, chooses the largest and
+// lowers it by the total, so heavy backends are interleaved with light ones
+// instead of being picked in bursts. One period of the sequence is computed
+// when the backends change and picks walk it with an atomic counter.
+type WeightedRoundRobinStrategy struct {
+	idx      uint64
+	list     backendList
+	schedule atomic.Value // []Backend
+}
+
+func (s *WeightedRoundRobinStrategy) NextBackend(sel *Selection) (Backend, error) {
+	schedule, _ := s.schedule.Load().([]Backend)
+	n := uint64(len(schedule))
+
+	// slots of unavailable backends are skipped rather than handed to their
+	// neighbour, so the others keep their proportions
+	for i := uint64(0); i < n; i++ {
+		backend := schedule[(atomic.AddUint64(&s.idx, 1)-1)%n]
+		if sel.accepts(backend) {
+			return backend, nil
+		}
+	}
+
+	return Backend{}, errNoBackends
+}
+
+func (s *WeightedRoundRobinStrategy) AddBackend(backend Backend) {
+	s.list.add(backend, s.buildSchedule)
+}
+
+func (s *WeightedRoundRobinStrategy) Backends() []Backend {
+	return s.list.copy()
+}
+
+func (s *WeightedRoundRobinStrategy) SetBackends(backends []Backend) {
+	s.list.set(backends, s.buildSchedule)
+}
+
+func (s *WeightedRoundRobinStrategy) DeleteBackend(id string) error {
+	return s.list.remove(id, s.buildSchedule)
+}
+
+func (s *WeightedRoundRobinStrategy) buildSchedule(backends []Backend) {
+	if len(backends) == 0 {
+		s.schedule.Store([]Backend(nil))
+		return
+	}
+
+	weights := make([]int, len(backends))
+	divisor, total := 0, 0
+	for i, backend := range backends {
+		weights[i] = backend.weight()
+		divisor = gcd(divisor, weights[i])
+		total += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= divisor
+	}
+	if total /= divisor; total > maxWeightSchedule {
+		scaled := 0
+		for i := range weights {
+			if weights[i] = weights[i] * maxWeightSchedule / total; weights[i] < 1 {
+				weights[i] = 1
+			}
+			scaled += weights[i]
+		}
+		total = scaled
+	}
+
+	schedule := make([]Backend, 0, total)
+	current := make([]int, len(backends))
+	for len(schedule) < total {
+		best := 0
+		for i := range backends {
+			current[i] += weights[i]
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, backends[best])
+	}
+
+	s.schedule.Store(schedule)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+const defaultHashReplicas = 160
+
+// ConsistentHashStrategy maps client IPs onto a hash ring with virtual nodes
+// for every backend, so a client keeps its backend and adding or removing a
+// backend only moves the clients of its own ring segments.
+type ConsistentHashStrategy struct {
+	// virtual nodes per unit of backend weight
+	Replicas int
+
+	list backendList
+	ring atomic.Value // []ringPoint, sorted by hash
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend Backend
+}
+
+func (s *ConsistentHashStrategy) NextBackend(sel *Selection) (Backend, error) {
+	ring, _ := s.ring.Load().([]ringPoint)
+
+	hash := crc32.ChecksumIEEE([]byte(sel.clientIP()))
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+
+	// walk clockwise past the points of unavailable backends
+	for n := 0; n < len(ring); n++ {
+		backend := ring[(i+n)%len(ring)].backend
+		if sel.accepts(backend) {
+			return backend, nil
+		}
+	}
+
+	return Backend{}, errNoBackends
+}
+
+func (s *ConsistentHashStrategy) AddBackend(backend Backend) {
+	s.list.add(backend, s.buildRing)
+}
+
+func (s *ConsistentHashStrategy) Backends() []Backend {
+	return s.list.copy()
+}
+
+func (s *ConsistentHashStrategy) SetBackends(backends []Backend) {
+	s.list.set(backends, s.buildRing)
+}
+
+func (s *ConsistentHashStrategy) DeleteBackend(id string) error {
+	return s.list.remove(id, s.buildRing)
+}
+
+// buildRing places the virtual nodes of every backend on the ring. Points
+// depend on backend ids only, so the rest of the ring stays put when a
+// backend comes or goes.
+func (s *ConsistentHashStrategy) buildRing(backends []Backend) {
+	replicas := s.Replicas
+	if replicas <= 0 {
+		replicas = defaultHashReplicas
+	}
+
+	var ring []ringPoint
+	for _, backend := range backends {
+		n := replicas * backend.weight()
+		for r := 0; r < n; r++ {
+			hash := crc32.ChecksumIEEE([]byte(backend.Id + "-" + strconv.Itoa(r)))
+			ring = append(ring, ringPoint{hash: hash, backend: backend})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	s.ring.Store(ring)
+}
+
+// PowerOfTwoStrategy samples two healthy backends at random and picks the one
+// with the lower score, combining dial latency and outstanding connections.
+// Slow backends lose most comparisons while still being probed now and then.
+type PowerOfTwoStrategy struct {
+	list backendList
+}
+
+func (s *PowerOfTwoStrategy) NextBackend(sel *Selection) (Backend, error) {
+	backends := s.list.load()
+
+	available := make([]Backend, 0, len(backends))
+	candidates := make([]Backend, 0, len(backends))
+	for _, backend := range backends {
+		if !sel.accepts(backend) {
+			continue
+		}
+		available = append(available, backend)
+		if !backend.failing() {
+			candidates = append(candidates, backend)
+		}
+	}
+	// better to try a failed backend than to drop the connection
+	if len(candidates) == 0 {
+		candidates = available
+	}
+
+	n := len(candidates)
+	if n == 0 {
+		return Backend{}, errNoBackends
+	}
+	if n == 1 {
+		return candidates[0], nil
+	}
+
+	i := randIntn(n)
+	j := randIntn(n - 1)
+	if j >= i {
+		j++
+	}
+
+	if candidates[j].score() < candidates[i].score() {
+		return candidates[j], nil
+	}
+	return candidates[i], nil
+}
+
+func (s *PowerOfTwoStrategy) AddBackend(backend Backend) {
+	s.list.add(backend, nil)
+}
+
+func (s *PowerOfTwoStrategy) Backends() []Backend {
+	return s.list.copy()
+}
+
+func (s *PowerOfTwoStrategy) SetBackends(backends []Backend) {
+	s.list.set(backends, nil)
+}
+
+func (s *PowerOfTwoStrategy) DeleteBackend(id string) error {
+	return s.list.remove(id, nil)
+}
+
+// PriorityStrategy groups backends into tiers by priority and balances
+// within the lowest tier that still has a working backend, with a separate
+// strategy of the configured kind per tier. Backup tiers get traffic only
+// while every primary has failed or is gone, and give it back as soon as
+// a primary is healthy again.
+type PriorityStrategy struct {
+	mu      sync.Mutex
+	newTier func() BackendStrategy
+	tiers   atomic.Value // []*priorityTier, sorted by tier
+}
+
+// priorityTier is not modified once published, changes replace it
+type priorityTier struct {
+	key      tierKey
+	backends []Backend
+	strategy BackendStrategy
+}
+
+func NewPriorityStrategy(newTier func() BackendStrategy) *PriorityStrategy {
+	return &PriorityStrategy{newTier: newTier}
+}
+
+func (s *PriorityStrategy) load() []*priorityTier {
+	tiers, _ := s.tiers.Load().([]*priorityTier)
+	return tiers
+}
+
+func (s *PriorityStrategy) NextBackend(sel *Selection) (Backend, error) {
+	var fallback *priorityTier
+	for _, tier := range s.load() {
+		for _, backend := range tier.backends {
+			if !sel.accepts(backend) {
+				continue
+			}
+			if !backend.failing() {
+				return tier.next(sel)
+			}
+			if fallback == nil {
+				fallback = tier
+			}
+		}
+	}
+
+	// everything failed, keep trying the lowest tier that takes connections
+	if fallback == nil {
+		return Backend{}, errNoBackends
+	}
+	return fallback.next(sel)
+}
+
+// next picks a backend of the tier. A backend in slow start keeps a pick
+// only with the probability of its ramp factor, otherwise the pick moves on.
+func (t *priorityTier) next(sel *Selection) (Backend, error) {
+	backend, err := t.strategy.NextBackend(sel)
+	for i := 1; err == nil && i < len(t.backends); i++ {
+		if ramp := backend.rampFactor(); ramp >= 1 || randFloat64() < ramp {
+			break
+		}
+		backend, err = t.strategy.NextBackend(sel)
+	}
+	return backend, err
+}
+
+func (s *PriorityStrategy) Backends() []Backend {
+	var backends []Backend
+	for _, tier := range s.load() {
+		backends = append(backends, tier.backends...)
+	}
+	return backends
+}
+
+func (s *PriorityStrategy) AddBackend(backend Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiers.Store(s.withBackend(s.load(), backend))
+}
+
+// withBackend returns a copy of tiers with backend added to its tier
+func (s *PriorityStrategy) withBackend(tiers []*priorityTier, backend Backend) []*priorityTier {
+	key := backend.tier()
+	i := sort.Search(len(tiers), func(i int) bool { return !tiers[i].key.before(key) })
+
+	res := make([]*priorityTier, 0, len(tiers)+1)
+	res = append(res, tiers[:i]...)
+	if i < len(tiers) && tiers[i].key == key {
+		tier := tiers[i]
+		tier.strategy.AddBackend(backend)
+		res = append(res, &priorityTier{
+			key:      key,
+			backends: append(tier.backends[:len(tier.backends):len(tier.backends)], backend),
+			strategy: tier.strategy,
+		})
+		i++
+	} else {
+		strategy := s.newTier()
+		strategy.AddBackend(backend)
+		res = append(res, &priorityTier{
+			key:      key,
+			backends: []Backend{backend},
+			strategy: strategy,
+		})
+	}
+
+	return append(res, tiers[i:]...)
+}
+
+func (s *PriorityStrategy) SetBackends(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tiers []*priorityTier
+	for _, backend := range backends {
+		tiers = s.withBackend(tiers, backend)
+	}
+	s.tiers.Store(tiers)
+}
+
+func (s *PriorityStrategy) DeleteBackend(id string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tiers := s.load()
+	for i, tier := range tiers {
+		var backends []Backend
+		if backends, err = deleteBackend(tier.backends, id); err != nil {
+			continue
+		}
+
+		res := make([]*priorityTier, 0, len(tiers))
+		res = append(res, tiers[:i]...)
+		if len(backends) > 0 {
+			tier.strategy.DeleteBackend(id)
+			res = append(res, &priorityTier{
+				key:      tier.key,
+				backends: backends,
+				strategy: tier.strategy,
+			})
+		}
+		s.tiers.Store(append(res, tiers[i+1:]...))
+		return nil
+	}
+
+	return err
+}
+
+// deleteBackend returns a copy of backends without the backend with given id
+func deleteBackend(backends []Backend, id string) ([]Backend, error) {
+	for i, backend := range backends {
 		if backend.Id == id {
-			s.backends = append(s.backends[:i], s.backends[i+1:]...)
-			return nil
+			res := make([]Backend, 0, len(backends)-1)
+			res = append(res, backends[:i]...)
+			return append(res, backends[i+1:]...), nil
 		}
 	}
 
-	return errors.New(fmt.Sprintf("Unknown backend id: %s", id))
+	return backends, errors.New(fmt.Sprintf("Unknown backend id: %s", id))
+}
+
+// Selection describes the client connection a backend is picked for
+type Selection struct {
+	ClientAddr string
+	// path of the request in http mode
+	Path string
+	// backend group the connection goes to, split by the group weights if empty
+	Group string
+
+	// ids of backends that already failed to take the connection
+	tried []string
 }
 
+// accepts reports whether backend may be picked for the connection
+func (sel *Selection) accepts(backend Backend) bool {
+	if !backend.Available() {
+		return false
+	}
+	if sel != nil {
+		for _, id := range sel.tried {
+			if id == backend.Id {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// clientIP returns the client address without port
+func (sel *Selection) clientIP() string {
+	if sel == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(sel.ClientAddr)
+	if err != nil {
+		return sel.ClientAddr
+	}
+	return host
+}
+
+// BackendStrategy picks backends for new connections. NextBackend is called
+// concurrently with every other method and must not block.
 type BackendStrategy interface {
-	NextBackend() (Backend, error)
+	NextBackend(sel *Selection) (Backend, error)
 	AddBackend(backend Backend)
 	DeleteBackend(id string) error
 	SetBackends(backends []Backend)
+	Backends() []Backend
+}
+
+// selectiveStrategy splits its backends by the selection, like routes and
+// groups do
+type selectiveStrategy interface {
+	backendsFor(sel *Selection) []Backend
+}
+
+// selectableBackends returns the backends strategy may pick for sel
+func selectableBackends(strategy BackendStrategy, sel *Selection) []Backend {
+	if s, ok := strategy.(selectiveStrategy); ok {
+		return s.backendsFor(sel)
+	}
+	return strategy.Backends()
+}
+
+const defaultStrategy = "round_robin"
+
+// strategyFactories builds strategies by the name used in the frontend json.
+// params holds the optional "strategy_params" object of the frontend.
+var strategyFactories = map[string]func(params json.RawMessage) (BackendStrategy, error){
+	"round_robin": func(params json.RawMessage) (BackendStrategy, error) {
+		return &RoundRobinStrategy{}, nil
+	},
+	"least_connections": func(params json.RawMessage) (BackendStrategy, error) {
+		return &LeastConnectionsStrategy{}, nil
+	},
+	"weighted_round_robin": func(params json.RawMessage) (BackendStrategy, error) {
+		return &WeightedRoundRobinStrategy{}, nil
+	},
+	"consistent_hash": func(params json.RawMessage) (BackendStrategy, error) {
+		var tmp struct {
+			Replicas int `json:"replicas"`
+		}
+		if len(params) != 0 {
+			if err := json.Unmarshal(params, &tmp); err != nil {
+				return nil, err
+			}
+		}
+		return &ConsistentHashStrategy{Replicas: tmp.Replicas}, nil
+	},
+	"power_of_two": func(params json.RawMessage) (BackendStrategy, error) {
+		return &PowerOfTwoStrategy{}, nil
+	},
+}
+
+// NewStrategy creates a registered strategy, empty name means the default one.
+// Backends are split into priority tiers, each balanced by its own strategy.
+func NewStrategy(name string, params json.RawMessage) (BackendStrategy, error) {
+	if name == "" {
+		name = defaultStrategy
+	}
+
+	factory, ok := strategyFactories[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown strategy: %s", name))
+	}
+
+	// fail early on bad params, every tier is built the same way
+	if _, err := factory(params); err != nil {
+		return nil, err
+	}
+
+	return NewPriorityStrategy(func() BackendStrategy {
+		strategy, _ := factory(params)
+		return strategy
+	}), nil
 }
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeastConnectionsStrategy(t *testing.T) {
+	s := &LeastConnectionsStrategy{}
+
+	if _, err := s.NextBackend(nil); err == nil {
+		t.Fatalf("Expected error on empty strategy")
+	}
+
+	b1, b2, b3 := NewBackend("b1"), NewBackend("b2"), NewBackend("b3")
+	s.SetBackends([]Backend{b1, b2, b3})
+
+	b1.connOpened()
+	b1.connOpened()
+	b3.connOpened()
+
+	backend, err := s.NextBackend(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.Id != "b2" {
+		t.Fatalf("Expected b2, got %s", backend.Id)
+	}
+
+	b2.connOpened()
+	b2.connOpened()
+	backend, _ = s.NextBackend(nil)
+	if backend.Id != "b3" {
+		t.Fatalf("Expected b3, got %s", backend.Id)
+	}
+
+	if err := s.DeleteBackend("b3"); err != nil {
+		t.Fatal(err)
+	}
+	b1.connClosed()
+	backend, _ = s.NextBackend(nil)
+	if backend.Id != "b1" {
+		t.Fatalf("Expected b1, got %s", backend.Id)
+	}
+}
+
+func newWeightedBackend(id string, weight int) Backend {
+	backend := NewBackend(id)
+	backend.Weight = weight
+	return backend
+}
+
+func TestWeightedRoundRobinStrategy(t *testing.T) {
+	s := &WeightedRoundRobinStrategy{}
+	s.SetBackends([]Backend{
+		newWeightedBackend("a", 5),
+		newWeightedBackend("b", 1),
+		newWeightedBackend("c", 1),
+	})
+
+	// the nginx reference sequence for weights 5, 1, 1
+	expected := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 2; round++ {
+		for i, id := range expected {
+			backend, err := s.NextBackend(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backend.Id != id {
+				t.Fatalf("Round %d pick %d: expected %s, got %s", round, i, id, backend.Id)
+			}
+		}
+	}
+
+	s.DeleteBackend("a")
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		backend, _ := s.NextBackend(nil)
+		counts[backend.Id]++
+	}
+	if counts["b"] != 5 || counts["c"] != 5 {
+		t.Fatalf("Unexpected distribution after delete: %v", counts)
+	}
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	s := &ConsistentHashStrategy{}
+	s.SetBackends([]Backend{NewBackend("b1"), NewBackend("b2"), NewBackend("b3"), NewBackend("b4")})
+
+	picks := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:%d", i/256, i%256, 40000+i)
+		backend, err := s.NextBackend(&Selection{ClientAddr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[addr] = backend.Id
+
+		// the port must not matter
+		again, _ := s.NextBackend(&Selection{ClientAddr: fmt.Sprintf("10.0.%d.%d:1", i/256, i%256)})
+		if again.Id != backend.Id {
+			t.Fatalf("Client %s moved from %s to %s", addr, backend.Id, again.Id)
+		}
+	}
+
+	s.DeleteBackend("b2")
+	moved := 0
+	for addr, id := range picks {
+		backend, _ := s.NextBackend(&Selection{ClientAddr: addr})
+		if backend.Id != id {
+			if id != "b2" {
+				t.Fatalf("Client %s moved from %s to %s", addr, id, backend.Id)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Fatalf("Unexpected number of moved clients: %d", moved)
+	}
+
+	s.AddBackend(NewBackend("b5"))
+	for addr, id := range picks {
+		backend, _ := s.NextBackend(&Selection{ClientAddr: addr})
+		if backend.Id != id && backend.Id != "b5" && id != "b2" {
+			t.Fatalf("Client %s moved from %s to %s", addr, id, backend.Id)
+		}
+	}
+}
+
+func TestPowerOfTwoStrategy(t *testing.T) {
+	s := &PowerOfTwoStrategy{}
+
+	fast, slow, dead := NewBackend("fast"), NewBackend("slow"), NewBackend("dead")
+	fast.dialSucceeded(time.Millisecond)
+	slow.dialSucceeded(100 * time.Millisecond)
+	dead.dialFailed()
+	s.SetBackends([]Backend{fast, slow, dead})
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		backend, err := s.NextBackend(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[backend.Id]++
+	}
+	if counts["dead"] != 0 {
+		t.Fatalf("Failed backend was picked %d times", counts["dead"])
+	}
+	if counts["slow"] != 0 {
+		t.Fatalf("Slow backend won a comparison: %v", counts)
+	}
+
+	// outstanding connections outweigh a latency advantage
+	for i := 0; i < 200; i++ {
+		fast.connOpened()
+	}
+	backend, _ := s.NextBackend(nil)
+	if backend.Id != "slow" {
+		t.Fatalf("Expected slow, got %s", backend.Id)
+	}
+}
+
+func TestNewStrategy(t *testing.T) {
+	s, err := NewStrategy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*PriorityStrategy).newTier().(*RoundRobinStrategy); !ok {
+		t.Fatalf("Expected round-robin as default strategy, got %T", s)
+	}
+
+	s, err = NewStrategy("consistent_hash", []byte(`{"replicas": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.(*PriorityStrategy).newTier().(*ConsistentHashStrategy).Replicas != 10 {
+		t.Fatalf("Strategy params were not applied")
+	}
+
+	if _, err := NewStrategy("random", nil); err == nil {
+		t.Fatalf("Expected error on unknown strategy")
+	}
+}
+
+func TestFrontendSetStrategy(t *testing.T) {
+	f := NewFrontend("f1")
+	f.SetBackends([]Backend{NewBackend("b1"), NewBackend("b2")})
+
+	if err := f.SetStrategy("least_connections", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.currentStrategy().(*GroupStrategy).newGroup().(*PriorityStrategy).newTier().(*LeastConnectionsStrategy); !ok {
+		t.Fatalf("Strategy was not swapped, got %T", f.currentStrategy())
+	}
+	if n := len(f.currentStrategy().Backends()); n != 2 {
+		t.Fatalf("Expected 2 backends after swap, got %d", n)
+	}
+
+	if err := f.SetStrategy("random", nil); err == nil {
+		t.Fatalf("Expected error on unknown strategy")
+	}
+	if f.Strategy != "least_connections" {
+		t.Fatalf("Failed swap changed the strategy to %s", f.Strategy)
+	}
+}
+
+func TestRouteStrategy(t *testing.T) {
+	tagged := func(id string, tags ...string) Backend {
+		backend := NewBackend(id)
+		backend.Tags = tags
+		return backend
+	}
+
+	f := newTestFrontend(t, tagged("api1", "api"), tagged("cdn1", "assets"), tagged("both", "api", "assets"), NewBackend("web1"))
+	err := f.SetRoutes([]Route{
+		{Path: "/api/", Tags: []string{"api"}},
+		{Path: "/api/static/", Tags: []string{"assets"}, Strategy: "least_connections"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.isHTTP() {
+		t.Fatalf("Routes did not turn on http mode")
+	}
+
+	expected := map[string][]string{
+		"/api/users":      {"api1", "both"},
+		"/api/static/app": {"cdn1", "both"},
+		"/":               {"web1"},
+		"/apis":           {"web1"},
+	}
+	for path, ids := range expected {
+		picked := make(map[string]bool)
+		for i := 0; i < 10; i++ {
+			backend, err := f.nextBackend(&Selection{ClientAddr: "10.0.0.1:80", Path: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked[backend.Id] = true
+		}
+		if len(picked) != len(ids) || !picked[ids[0]] || !picked[ids[len(ids)-1]] {
+			t.Fatalf("%s: expected backends %v, got %v", path, ids, picked)
+		}
+	}
+
+	if n := len(f.currentStrategy().Backends()); n != 4 {
+		t.Fatalf("Expected 4 distinct backends, got %d", n)
+	}
+	if err := f.DeleteBackend("both"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteBackend("both"); err == nil {
+		t.Fatalf("Expected error deleting unknown backend")
+	}
+
+	// without routes every backend is in the default set again
+	if err := f.SetRoutes(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.currentStrategy().Backends()); n != 3 {
+		t.Fatalf("Expected 3 backends after removing the routes, got %d", n)
+	}
+
+	if err := f.SetRoutes([]Route{{Path: "api", Tags: []string{"api"}}}); err == nil {
+		t.Fatalf("Expected error for route path without /")
+	}
+}
+
+func TestPriorityStrategy(t *testing.T) {
+	s, _ := NewStrategy("round_robin", nil)
+
+	p1, p2 := NewBackend("p1"), NewBackend("p2")
+	backup := NewBackend("backup")
+	backup.Backup = true
+	standby := NewBackend("standby")
+	standby.Priority = 5
+	s.SetBackends([]Backend{standby, backup, p1, p2})
+
+	next := func() string {
+		backend, err := s.NextBackend(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend.Id
+	}
+
+	for i := 0; i < 4; i++ {
+		if id := next(); id != "p1" && id != "p2" {
+			t.Fatalf("Expected a primary backend, got %s", id)
+		}
+	}
+
+	p1.dialFailed()
+	p2.dialFailed()
+	if id := next(); id != "standby" {
+		t.Fatalf("Expected standby, got %s", id)
+	}
+
+	s.DeleteBackend("standby")
+	if id := next(); id != "backup" {
+		t.Fatalf("Expected backup, got %s", id)
+	}
+
+	// primary is back
+	p2.dialSucceeded(time.Millisecond)
+	if id := next(); id != "p1" && id != "p2" {
+		t.Fatalf("Expected fail back to primary, got %s", id)
+	}
+
+	if n := len(s.Backends()); n != 3 {
+		t.Fatalf("Expected 3 backends, got %d", n)
+	}
+}
+
+func TestBackupAfterPrimaryTiers(t *testing.T) {
+	s, _ := NewStrategy("round_robin", nil)
+
+	primary, secondary := NewBackend("primary"), NewBackend("secondary")
+	secondary.Priority = 1
+	backup, lateBackup := NewBackend("backup"), NewBackend("late_backup")
+	backup.Backup = true
+	lateBackup.Backup = true
+	lateBackup.Priority = 1
+	s.SetBackends([]Backend{lateBackup, backup, secondary, primary})
+
+	expect := func(want string) {
+		for i := 0; i < 10; i++ {
+			backend, err := s.NextBackend(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backend.Id != want {
+				t.Fatalf("Expected %s, got %s", want, backend.Id)
+			}
+		}
+	}
+
+	expect("primary")
+	primary.dialFailed()
+	// backups share nothing with a healthy primary of any priority
+	expect("secondary")
+	secondary.dialFailed()
+	expect("backup")
+	backup.dialFailed()
+	expect("late_backup")
+}
+
+func TestSlowStart(t *testing.T) {
+	s, _ := NewStrategy("round_robin", nil)
+
+	var backends []Backend
+	for i := 0; i < 4; i++ {
+		backends = append(backends, NewBackend(fmt.Sprintf("b%d", i)))
+	}
+	fresh := NewBackend("fresh")
+	fresh.SlowStart = 60
+	fresh.startSlowStart()
+	s.SetBackends(append(backends, fresh))
+
+	if ramp := fresh.rampFactor(); ramp > 0.1 {
+		t.Fatalf("Expected ramp near zero, got %f", ramp)
+	}
+
+	picks := 0
+	for i := 0; i < 1000; i++ {
+		backend, _ := s.NextBackend(nil)
+		if backend.Id == "fresh" {
+			picks++
+		}
+	}
+	if picks > 20 {
+		t.Fatalf("Backend in slow start got %d of 1000 connections", picks)
+	}
+
+	// half way through the window
+	fresh.stats.rampStart = time.Now().Add(-30 * time.Second).UnixNano()
+	if ramp := fresh.rampFactor(); ramp < 0.45 || ramp > 0.55 {
+		t.Fatalf("Expected ramp around 0.5, got %f", ramp)
+	}
+
+	fresh.stats.rampStart = time.Now().Add(-time.Minute).UnixNano()
+	if ramp := fresh.rampFactor(); ramp != 1 {
+		t.Fatalf("Expected full share after the window, got %f", ramp)
+	}
+}
+
+// run with -race
+func TestUpdateBackendInPlace(t *testing.T) {
+	f := newTestFrontend(t)
+	app := NewApplication("app")
+	app.Frontends[f.Id] = f
+
+	backend := NewBackend("b1")
+	backend.SlowStart = 60
+	app.AddBackend(backend)
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := f.nextBackend(nil); err != nil {
+				t.Errorf("Single backend missing during update: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		update := NewBackend("b1")
+		update.SlowStart = 60
+		update.Weight = i%3 + 1
+		app.AddBackend(update)
+	}
+	close(stop)
+	wg.Wait()
+
+	backends := f.currentStrategy().Backends()
+	if len(backends) != 1 || backends[0].Weight != 1999%3+1 {
+		t.Fatalf("Expected the last update, got %v", backends)
+	}
+	if backends[0].stats != backend.stats {
+		t.Fatal("Update lost the runtime state of the backend")
+	}
+	if ramp := backends[0].rampFactor(); ramp > 0.1 {
+		t.Fatalf("Update restarted or ended slow start, ramp %f", ramp)
+	}
+}
+
+func TestDrainingBackend(t *testing.T) {
+	for name := range strategyFactories {
+		s, _ := NewStrategy(name, nil)
+
+		b1, b2 := NewBackend("b1"), NewBackend("b2")
+		s.SetBackends([]Backend{b1, b2})
+		b1.SetDraining(true)
+
+		for i := 0; i < 20; i++ {
+			backend, err := s.NextBackend(&Selection{ClientAddr: fmt.Sprintf("10.0.0.%d:80", i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backend.Id != "b2" {
+				t.Fatalf("%s: draining backend got a new connection", name)
+			}
+		}
+
+		b2.SetDraining(true)
+		if _, err := s.NextBackend(nil); err == nil {
+			t.Fatalf("%s: expected error when every backend drains", name)
+		}
+	}
+}
+
+func TestDrainSurvivesUpdate(t *testing.T) {
+	app := NewApplication("app")
+	app.Frontends["f1"] = newTestFrontend(t)
+	app.AddBackend(NewBackend("b1"))
+	app.Backends["b1"].Drain(true)
+
+	// a weight change in etcd keeps the drain of the operator
+	update := NewBackend("b1")
+	update.Weight = 5
+	app.AddBackend(update)
+	if !app.Backends["b1"].Draining() {
+		t.Fatalf("Update of the backend json cleared the drain")
+	}
+
+	app.Backends["b1"].Drain(false)
+	if app.Backends["b1"].Draining() {
+		t.Fatalf("Backend still draining after resume")
+	}
+
+	// the json drains by itself too, resuming clears it
+	update = NewBackend("b1")
+	update.SetDraining(true)
+	app.AddBackend(update)
+	if !app.Backends["b1"].Draining() {
+		t.Fatalf("Draining of the json not applied")
+	}
+	app.Backends["b1"].Drain(false)
+	if app.Backends["b1"].Draining() {
+		t.Fatalf("Resume did not clear the draining of the json")
+	}
+}
+
+// run with -race
+func TestStrategiesConcurrentAccess(t *testing.T) {
+	for name := range strategyFactories {
+		s, _ := NewStrategy(name, nil)
+		s.SetBackends([]Backend{NewBackend("b0"), NewBackend("b1")})
+
+		var wg sync.WaitGroup
+		stop := make(chan bool)
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					sel := &Selection{ClientAddr: fmt.Sprintf("10.0.0.%d:80", g)}
+					if backend, err := s.NextBackend(sel); err == nil && backend.Id == "" {
+						t.Errorf("%s: picked an empty backend", name)
+					}
+				}
+			}(g)
+		}
+
+		for i := 0; i < 200; i++ {
+			backend := NewBackend(fmt.Sprintf("b%d", i%5+2))
+			backend.Weight = i%3 + 1
+			backend.Backup = i%4 == 0
+			s.AddBackend(backend)
+			s.DeleteBackend(fmt.Sprintf("b%d", (i+2)%5+2))
+			if i%50 == 0 {
+				s.SetBackends([]Backend{NewBackend("b0"), NewBackend("b1")})
+			}
+		}
+
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestFrontendConcurrentStrategySwap(t *testing.T) {
+	f := newTestFrontend(t, NewBackend("b1"), NewBackend("b2"))
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := f.nextBackend(&Selection{ClientAddr: "10.0.0.1:80"}); err != nil {
+				t.Errorf("Backends were lost during a swap: %v", err)
+				return
+			}
+		}
+	}()
+
+	names := []string{"least_connections", "consistent_hash", "power_of_two", "weighted_round_robin", "round_robin"}
+	for i := 0; i < 100; i++ {
+		f.SetStrategy(names[i%len(names)], nil)
+		f.AddBackend(NewBackend("b3"))
+		f.DeleteBackend("b3")
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestCanaryGroups(t *testing.T) {
+	canary := NewBackend("canary1")
+	canary.Group = "canary"
+	f := newTestFrontend(t, NewBackend("stable1"), NewBackend("stable2"), canary)
+
+	rules := []CanaryRule{
+		{Header: "X-Canary", Value: "1", Group: "canary"},
+		{Cookie: "beta", Value: "true", Group: "canary"},
+	}
+
+	pick := func(header, cookie string) string {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if header != "" {
+			req.Header.Set("X-Canary", header)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "beta", Value: cookie})
+		}
+		backend, err := f.nextBackend(&Selection{ClientAddr: "10.0.0.1:80", Group: canaryGroup(rules, req)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend.Id
+	}
+
+	for i := 0; i < 10; i++ {
+		if id := pick("", ""); id == "canary1" {
+			t.Fatalf("Regular request reached the canary")
+		}
+		if id := pick("0", "false"); id == "canary1" {
+			t.Fatalf("Request with other values reached the canary")
+		}
+		if id := pick("1", ""); id != "canary1" {
+			t.Fatalf("Header did not select the canary, got %s", id)
+		}
+		if id := pick("", "true"); id != "canary1" {
+			t.Fatalf("Cookie did not select the canary, got %s", id)
+		}
+	}
+
+	// without available canaries the regular backends take over
+	canary.SetDraining(true)
+	if id := pick("1", ""); id == "canary1" {
+		t.Fatalf("Picked the draining canary")
+	}
+
+	if err := (CanaryRule{Header: "X-Canary"}).validate(); err == nil {
+		t.Fatalf("Expected error for canary rule without group")
+	}
+}
+
+func TestGroupWeights(t *testing.T) {
+	stable, canary := NewBackend("stable1"), NewBackend("canary1")
+	stable.Group, canary.Group = "stable", "canary"
+	f := newTestFrontend(t, stable, canary, NewBackend("regular1"))
+
+	app := NewApplication("u1")
+	app.Frontends[f.Id] = f
+	if err := app.SetGroups(map[string]int{"stable": 95, "canary": 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		backend, err := f.nextBackend(&Selection{ClientAddr: "10.0.0.1:80"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[backend.Id]++
+	}
+	if counts["regular1"] != 0 || counts["canary1"] < 100 || counts["canary1"] > 300 {
+		t.Fatalf("Expected about 5%% canary and no regular picks, got %v", counts)
+	}
+
+	// the weights survive a strategy change, an unavailable group falls over
+	f.SetStrategy("least_connections", nil)
+	stable.SetDraining(true)
+	for i := 0; i < 10; i++ {
+		if backend, _ := f.nextBackend(&Selection{ClientAddr: "10.0.0.1:80"}); backend.Id != "canary1" {
+			t.Fatalf("Expected canary while stable drains, got %s", backend.Id)
+		}
+	}
+
+	app.SetGroups(nil)
+	if backend, _ := f.nextBackend(&Selection{ClientAddr: "10.0.0.1:80"}); backend.Id != "regular1" {
+		t.Fatalf("Expected regular backend without weights, got %s", backend.Id)
+	}
+
+	if err := app.SetGroups(map[string]int{"stable": -1}); err == nil {
+		t.Fatalf("Expected error for negative weight")
+	}
+}